@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+	"workerlayer/messages"
+	"workerlayer/utl"
+
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+)
+
+const (
+	//time allowed for session message and writes
+	writeWait = 10 * time.Second
+	//kind of pending request - latency is kept per kind
+	kindSet  = "set"
+	kindList = "list"
+)
+
+//one websocket of load test
+type conn struct {
+	index int
+	ws    *websocket.Conn
+	r     *run
+
+	//gorilla allows one concurrent writer
+	wmux sync.Mutex
+
+	mux sync.Mutex
+	//sent requests by RequestID
+	pending map[string]request
+	//last value of every user of run seen in pushes
+	values map[string]int
+	//newest value of every user seen in pushes - values grow with every set of run
+	newestValues map[string]int
+	closing      bool
+	done         chan bool
+}
+
+type request struct {
+	kind   string
+	sentAt time.Time
+}
+
+//open websocket and wait for session message
+func dial(r *run, index int) (*conn, error) {
+	ws, _, err := websocket.DefaultDialer.Dial(r.cfg.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	ws.SetReadDeadline(time.Now().Add(writeWait))
+	if _, _, err := ws.ReadMessage(); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	ws.SetReadDeadline(time.Time{})
+	c := &conn{index: index, ws: ws, r: r, pending: make(map[string]request), values: make(map[string]int), newestValues: make(map[string]int), done: make(chan bool)}
+	go c.read()
+	return c, nil
+}
+
+func (c *conn) set(user string, value int) {
+	rq := messages.ClientSetFavoriteNumber{
+		ClientRQ: messages.ClientRQ{Cmd: messages.RQSetFavoriteNumber},
+		CmdData:  messages.SetFavoriteNumber{UserName: user, FavoriteNumber: value},
+	}
+	c.send(kindSet, &rq.ClientRQ, &rq)
+}
+
+func (c *conn) list() {
+	rq := messages.ClientGetList{ClientRQ: messages.ClientRQ{Cmd: messages.RQListAllUsers}}
+	c.send(kindList, &rq.ClientRQ, &rq)
+}
+
+//delete without waiting for reply - cleanup at the end
+func (c *conn) delete(user string) {
+	rq := messages.ClientDeleteUser{ClientRQ: messages.ClientRQ{Cmd: messages.RQDeleteUser}, CmdData: messages.DeleteUser{UserName: user}}
+	c.write(utl.JSON(rq))
+}
+
+//send request with fresh RequestID in hdr
+func (c *conn) send(kind string, hdr *messages.ClientRQ, rq interface{}) {
+	hdr.RequestID = uuid.New()
+	c.mux.Lock()
+	c.pending[hdr.RequestID] = request{kind: kind, sentAt: time.Now()}
+	c.mux.Unlock()
+	c.r.st.sent(kind)
+	if err := c.write(utl.JSON(rq)); err != nil {
+		c.r.st.sendFailed(kind)
+	}
+}
+
+func (c *conn) write(m []byte) error {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.ws.WriteMessage(websocket.TextMessage, m)
+}
+
+//read replies and pushes until connection is closed - pings are answered by default handler
+func (c *conn) read() {
+	defer close(c.done)
+	for {
+		_, m, err := c.ws.ReadMessage()
+		at := time.Now()
+		if err != nil {
+			c.mux.Lock()
+			closing := c.closing
+			c.mux.Unlock()
+			if !closing {
+				c.r.st.connLost(err)
+			}
+			return
+		}
+		c.r.st.received()
+		c.dispatch(m, at)
+	}
+}
+
+func (c *conn) dispatch(m []byte, at time.Time) {
+	rp := struct {
+		messages.Reply
+		AllUsers []messages.User
+	}{}
+	if err := json.Unmarshal(m, &rp); err != nil {
+		return
+	}
+	if rp.RequestID != "" {
+		c.mux.Lock()
+		rq, exists := c.pending[rp.RequestID]
+		delete(c.pending, rp.RequestID)
+		c.mux.Unlock()
+		if exists {
+			c.r.st.replied(rq.kind, at.Sub(rq.sentAt), rp.Status == messages.StatusOK)
+		}
+		return
+	}
+	if rp.Cmd != messages.SrvListAllUsers {
+		return
+	}
+	//push - every changed value of run is one delivery of its set
+	prefix := "lt-" + c.r.id + "-"
+	for _, u := range rp.AllUsers {
+		if !strings.HasPrefix(u.Username, prefix) {
+			continue
+		}
+		c.mux.Lock()
+		changed := c.values[u.Username] != u.Favnum
+		c.values[u.Username] = u.Favnum
+		if u.Favnum > c.newestValues[u.Username] {
+			c.newestValues[u.Username] = u.Favnum
+		}
+		c.mux.Unlock()
+		if changed {
+			c.r.observe(c.index, u.Username, u.Favnum, at)
+		}
+	}
+}
+
+//newest value of user this connection saw, 0 if none
+func (c *conn) newest(user string) int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.newestValues[user]
+}
+
+//requests without reply
+func (c *conn) unanswered() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return len(c.pending)
+}
+
+func (c *conn) close() {
+	c.mux.Lock()
+	c.closing = true
+	c.mux.Unlock()
+	c.wmux.Lock()
+	c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.wmux.Unlock()
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+	}
+	c.ws.Close()
+}
@@ -0,0 +1,253 @@
+// loadtest opens many websockets to weblayer, sends set/list requests at fixed rate and
+// measures fan-out latency: time from a set to the push with the new value on every other connection
+//
+// every set writes a value that is unique in the run, so a push tells which set it shows.
+// users of the run are named lt-{run}-{n} and deleted at the end.
+//
+//	loadtest --conns=500 --rate=50 --duration=1m
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"workerlayer/utl"
+
+	"github.com/docopt/docopt-go"
+	"github.com/pborman/uuid"
+)
+
+var usage = `loadtest
+
+Usage:
+  loadtest [--url=url] [--conns=n] [--rate=r] [--duration=d] [--users=n] [--list-ratio=f] [--dial-parallel=n] [--drain=d] [--keep-users]
+  loadtest -h | --help
+
+Options:
+  -h --help          Show this screen.
+  --url=url          Websocket endpoint [default ws://localhost:9999/ws]
+  --conns=n          Websocket connections [default 100]
+  --rate=r           Requests per second over all connections [default 20]
+  --duration=d       Time of sending requests [default 30s]
+  --users=n          Users the sets are spread over [default 10]
+  --list-ratio=f     Share of list requests, 0..1, rest are sets [default 0.1]
+  --dial-parallel=n  Connections dialed at the same time [default 50]
+  --drain=d          Wait for pushes after last request [default 3s]
+  --keep-users       Do not delete users of the run
+  `
+
+type config struct {
+	url          string
+	conns        int
+	rate         float64
+	duration     time.Duration
+	users        int
+	listRatio    float64
+	dialParallel int
+	drain        time.Duration
+	keepUsers    bool
+}
+
+func main() {
+	arguments, _ := docopt.Parse(usage, nil, true, "loadtest 2.0", false)
+	cfg, err := parseConfig(arguments)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "loadtest:", err)
+		os.Exit(1)
+	}
+	utl.ConfigureLog(utl.LogOptions{Format: utl.FormatText, Level: "warn"})
+
+	st := newStats()
+	run := newRun(cfg, st)
+
+	utl.WARN("loadtest", "dialing", cfg.conns, "connections to", cfg.url)
+	start := time.Now()
+	run.dial()
+	st.dialTime = time.Since(start)
+	if len(run.conns) < 2 {
+		fmt.Fprintln(os.Stderr, "loadtest: fan-out needs at least 2 connections, got", len(run.conns))
+		st.writeErrors(os.Stderr)
+		os.Exit(1)
+	}
+
+	utl.WARN("loadtest", "sending", cfg.rate, "requests/s for", cfg.duration)
+	run.send()
+	time.Sleep(cfg.drain)
+	run.close()
+
+	st.report(os.Stdout, cfg, run)
+}
+
+func parseConfig(arguments map[string]interface{}) (config, error) {
+	cfg := config{url: "ws://localhost:9999/ws", conns: 100, rate: 20, duration: 30 * time.Second,
+		users: 10, listRatio: 0.1, dialParallel: 50, drain: 3 * time.Second}
+	var err error
+	str := func(flag string) (string, bool) {
+		v, _ := arguments[flag].(string)
+		return v, v != "" && err == nil
+	}
+	if v, ok := str("--url"); ok {
+		cfg.url = v
+	}
+	if v, ok := str("--conns"); ok {
+		cfg.conns, err = strconv.Atoi(v)
+	}
+	if v, ok := str("--rate"); ok {
+		cfg.rate, err = strconv.ParseFloat(v, 64)
+	}
+	if v, ok := str("--duration"); ok {
+		cfg.duration, err = time.ParseDuration(v)
+	}
+	if v, ok := str("--users"); ok {
+		cfg.users, err = strconv.Atoi(v)
+	}
+	if v, ok := str("--list-ratio"); ok {
+		cfg.listRatio, err = strconv.ParseFloat(v, 64)
+	}
+	if v, ok := str("--dial-parallel"); ok {
+		cfg.dialParallel, err = strconv.Atoi(v)
+	}
+	if v, ok := str("--drain"); ok {
+		cfg.drain, err = time.ParseDuration(v)
+	}
+	cfg.keepUsers, _ = arguments["--keep-users"].(bool)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.conns < 2 || cfg.rate <= 0 || cfg.duration <= 0 || cfg.users < 1 || cfg.dialParallel < 1 || cfg.listRatio < 0 || cfg.listRatio > 1 {
+		return cfg, fmt.Errorf("expected conns >= 2, rate > 0, duration > 0, users >= 1, dial-parallel >= 1, list-ratio in 0..1")
+	}
+	return cfg, nil
+}
+
+//one load test - connections and sets sent over them
+type run struct {
+	cfg   config
+	st    *stats
+	id    string
+	conns []*conn
+
+	mux sync.Mutex
+	//sets by value - value is unique in run
+	sets map[int]*set
+	//last value given to a set
+	next int
+}
+
+//one set request - seen has indexes of connections that got push with its value
+type set struct {
+	user   string
+	sentAt time.Time
+	sender int
+	seen   map[int]bool
+}
+
+func newRun(cfg config, st *stats) *run {
+	return &run{cfg: cfg, st: st, id: uuid.New()[:8], sets: make(map[int]*set)}
+}
+
+func (r *run) userName(n int) string {
+	return fmt.Sprintf("lt-%s-%d", r.id, n)
+}
+
+//open connections, dialParallel at a time
+func (r *run) dial() {
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	slots := make(chan bool, r.cfg.dialParallel)
+	for i := 0; i < r.cfg.conns; i++ {
+		wg.Add(1)
+		slots <- true
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			c, err := dial(r, i)
+			if err != nil {
+				r.st.dialFailed(err)
+				return
+			}
+			mux.Lock()
+			r.conns = append(r.conns, c)
+			mux.Unlock()
+		}(i)
+	}
+	wg.Wait()
+}
+
+//send requests at rate from random connections for duration
+func (r *run) send() {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / r.cfg.rate))
+	defer ticker.Stop()
+	end := time.After(r.cfg.duration)
+	for {
+		select {
+		case <-end:
+			return
+		case <-ticker.C:
+			c := r.conns[rand.Intn(len(r.conns))]
+			if rand.Float64() < r.cfg.listRatio {
+				c.list()
+				continue
+			}
+			r.mux.Lock()
+			r.next++
+			value := r.next
+			s := &set{user: r.userName(rand.Intn(r.cfg.users)), sentAt: time.Now(), sender: c.index, seen: make(map[int]bool)}
+			r.sets[value] = s
+			r.mux.Unlock()
+			c.set(s.user, value)
+		}
+	}
+}
+
+//push with value of user came to connection index - latency of fan-out when value is from this run
+func (r *run) observe(index int, user string, value int, at time.Time) {
+	r.mux.Lock()
+	s := r.sets[value]
+	if s == nil || s.user != user || s.sender == index {
+		r.mux.Unlock()
+		return
+	}
+	s.seen[index] = true
+	r.mux.Unlock()
+	r.st.fanOut.add(at.Sub(s.sentAt))
+}
+
+//delete users of run and close connections
+func (r *run) close() {
+	if !r.cfg.keepUsers {
+		for n := 0; n < r.cfg.users; n++ {
+			r.conns[0].delete(r.userName(n))
+		}
+	}
+	for _, c := range r.conns {
+		c.close()
+	}
+}
+
+//sets and deliveries they should have - every set goes to every connection except sender,
+//unless a later set of the same user replaced the value before push to that connection
+//(connection saw a newer value) - server rightly sends only current list then
+func (r *run) deliveries() (sets, expected, delivered, replaced int) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for value, s := range r.sets {
+		sets++
+		for _, c := range r.conns {
+			switch {
+			case c.index == s.sender:
+			case s.seen[c.index]:
+				expected++
+				delivered++
+			case c.newest(s.user) > value:
+				replaced++
+			default:
+				expected++
+			}
+		}
+	}
+	return sets, expected, delivered, replaced
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+//latency samples of one kind
+type samples struct {
+	mux sync.Mutex
+	d   []time.Duration
+}
+
+func (s *samples) add(d time.Duration) {
+	s.mux.Lock()
+	s.d = append(s.d, d)
+	s.mux.Unlock()
+}
+
+//p-th percentile (0..100) and count - nearest rank
+func (s *samples) percentiles(ps ...float64) ([]time.Duration, int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	sort.Slice(s.d, func(i, j int) bool { return s.d[i] < s.d[j] })
+	out := make([]time.Duration, len(ps))
+	if len(s.d) == 0 {
+		return out, 0
+	}
+	for i, p := range ps {
+		rank := int(p/100*float64(len(s.d))+0.5) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		if rank >= len(s.d) {
+			rank = len(s.d) - 1
+		}
+		out[i] = s.d[rank]
+	}
+	return out, len(s.d)
+}
+
+//counters of run - safe for read go routines of all connections
+type stats struct {
+	dialTime time.Duration
+	fanOut   samples
+	//reply latency by request kind
+	replies map[string]*samples
+
+	messages int64
+
+	mux       sync.Mutex
+	dialErrs  int
+	lost      int
+	errors    map[string]int
+	sentBy    map[string]int
+	failedBy  map[string]int
+	okBy      map[string]int
+	notOKBy   map[string]int
+	startedAt time.Time
+}
+
+func newStats() *stats {
+	return &stats{
+		replies:   map[string]*samples{kindSet: {}, kindList: {}},
+		errors:    make(map[string]int),
+		sentBy:    make(map[string]int),
+		failedBy:  make(map[string]int),
+		okBy:      make(map[string]int),
+		notOKBy:   make(map[string]int),
+		startedAt: time.Now(),
+	}
+}
+
+func (st *stats) dialFailed(err error) {
+	st.mux.Lock()
+	st.dialErrs++
+	st.errors[err.Error()]++
+	st.mux.Unlock()
+}
+
+func (st *stats) connLost(err error) {
+	st.mux.Lock()
+	st.lost++
+	st.errors[err.Error()]++
+	st.mux.Unlock()
+}
+
+func (st *stats) sent(kind string) {
+	st.mux.Lock()
+	st.sentBy[kind]++
+	st.mux.Unlock()
+}
+
+func (st *stats) sendFailed(kind string) {
+	st.mux.Lock()
+	st.failedBy[kind]++
+	st.mux.Unlock()
+}
+
+func (st *stats) replied(kind string, d time.Duration, ok bool) {
+	st.replies[kind].add(d)
+	st.mux.Lock()
+	if ok {
+		st.okBy[kind]++
+	} else {
+		st.notOKBy[kind]++
+	}
+	st.mux.Unlock()
+}
+
+func (st *stats) received() {
+	atomic.AddInt64(&st.messages, 1)
+}
+
+//write results of finished run
+func (st *stats) report(w io.Writer, cfg config, r *run) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	unanswered := 0
+	for _, c := range r.conns {
+		unanswered += c.unanswered()
+	}
+	elapsed := time.Since(st.startedAt)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "target\t%s, %d connections, %.1f requests/s for %v\n", cfg.url, cfg.conns, cfg.rate, cfg.duration)
+	fmt.Fprintf(tw, "connections\t%d opened in %v, %d failed to open, %d lost during run\n",
+		len(r.conns), st.dialTime.Round(time.Millisecond), st.dialErrs, st.lost)
+	for _, kind := range []string{kindSet, kindList} {
+		fmt.Fprintf(tw, "%s requests\t%d sent, %d OK, %d NOTOK, %d failed to send\n",
+			kind, st.sentBy[kind], st.okBy[kind], st.notOKBy[kind], st.failedBy[kind])
+	}
+	fmt.Fprintf(tw, "unanswered\t%d requests without reply\n", unanswered)
+	sets, expected, delivered, replaced := r.deliveries()
+	notSeen := expected - delivered
+	pct := 0.0
+	if expected > 0 {
+		pct = 100 * float64(notSeen) / float64(expected)
+	}
+	fmt.Fprintf(tw, "fan-out\t%d sets, %d expected deliveries, %d delivered, %d not seen (%.2f%%), %d replaced before push\n",
+		sets, expected, delivered, notSeen, pct, replaced)
+	fmt.Fprintf(tw, "messages\t%d received, %.0f/s\n", atomic.LoadInt64(&st.messages), float64(atomic.LoadInt64(&st.messages))/elapsed.Seconds())
+	tw.Flush()
+
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "latency\tp50\tp90\tp99\tmax\tsamples\t")
+	row := func(name string, s *samples) {
+		p, n := s.percentiles(50, 90, 99, 100)
+		fmt.Fprintf(tw, "%s\t%v\t%v\t%v\t%v\t%d\t\n", name, round(p[0]), round(p[1]), round(p[2]), round(p[3]), n)
+	}
+	row("set -> push", &st.fanOut)
+	row("set reply", st.replies[kindSet])
+	row("list reply", st.replies[kindList])
+	tw.Flush()
+
+	if len(st.errors) > 0 {
+		fmt.Fprintln(w)
+		st.writeErrors(w)
+	}
+	if notSeen > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "not seen: connection never got the value nor a newer one of the same user - the push was")
+		fmt.Fprintln(w, "dropped for a slow connection, or the connection was lost")
+	}
+}
+
+//distinct dial and connection errors with counts - called when read go routines are done or under mux
+func (st *stats) writeErrors(w io.Writer) {
+	fmt.Fprintln(w, "connection errors:")
+	for e, n := range st.errors {
+		fmt.Fprintf(w, "  %dx %s\n", n, e)
+	}
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
@@ -0,0 +1,177 @@
+// admin package serves HTTP API for operators of weblayer
+//
+//	GET    /admin/connections       - live connections of all weblayer instances
+//	DELETE /admin/connections/{id}  - force close connection on whichever instance holds it
+//	POST   /admin/tokens            - issue user token, body {"User":"alice","TTL":"24h"}
+//	POST   /admin/announcements     - announce to clients of all instances,
+//	                                  body {"Text":"maintenance in 5 minutes","Level":"warning","Users":[],"Tags":[]}
+//
+// every request needs header Authorization: Bearer {admin token}
+// API is registered only when admin token is configured
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"weblayer/auth"
+	"weblayer/conn"
+	"workerlayer/metrics"
+	"workerlayer/utl"
+)
+
+const (
+	// time allowed for weblayer instances to reply
+	replyTimeout = 2 * time.Second
+	// validity of issued user token when request has no TTL
+	defaultTTL = 24 * time.Hour
+)
+
+var requests = metrics.NewCounter("weblayer_admin_requests_total", "Admin API requests, by method and status code.", "method", "code")
+
+type api struct {
+	token string
+	//HMAC key of user tokens - "" when auth is off
+	secret string
+}
+
+//register routes on mux - token authenticates admin, secret signs issued user tokens
+func Register(mux *http.ServeMux, token, secret string) {
+	a := &api{token: token, secret: secret}
+	mux.HandleFunc("/admin/connections", a.authorized(a.serveConnections))
+	mux.HandleFunc("/admin/connections/", a.authorized(a.serveConnection))
+	mux.HandleFunc("/admin/tokens", a.authorized(a.serveTokens))
+	mux.HandleFunc("/admin/announcements", a.authorized(a.serveAnnouncements))
+}
+
+//reject requests without admin token
+func (a *api) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(a.token)) != 1 {
+			utl.WARN(r.RemoteAddr, "admin", "unauthorized", r.Method, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="weblayer admin"`)
+			writeError(w, r, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// GET /admin/connections
+func (a *api) serveConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	list, err := conn.ListAll(replyTimeout)
+	if err != nil {
+		writeError(w, r, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, list)
+}
+
+// DELETE /admin/connections/{id}
+func (a *api) serveConnection(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/admin/connections/")
+	if id == "" || strings.Contains(id, "/") {
+		writeError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+	if r.Method != "DELETE" {
+		w.Header().Set("Allow", "DELETE")
+		writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	kicked, err := conn.KickAll(id, replyTimeout)
+	if err != nil {
+		writeError(w, r, http.StatusBadGateway, err.Error())
+		return
+	}
+	if !kicked {
+		writeError(w, r, http.StatusNotFound, "connection not found")
+		return
+	}
+	utl.INFO(r.RemoteAddr, "admin", "kicked connection", id)
+	w.WriteHeader(http.StatusNoContent)
+	requests.Inc(r.Method, strconv.Itoa(http.StatusNoContent))
+}
+
+// POST /admin/tokens
+func (a *api) serveTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if a.secret == "" {
+		writeError(w, r, http.StatusNotFound, "auth secret is not configured")
+		return
+	}
+
+	body := struct{ User, TTL string }{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.User == "" {
+		writeError(w, r, http.StatusBadRequest, `Expected body {"User":<name>,"TTL":<duration>}`)
+		return
+	}
+	ttl := defaultTTL
+	if body.TTL != "" {
+		d, err := time.ParseDuration(body.TTL)
+		if err != nil || d <= 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid TTL")
+			return
+		}
+		ttl = d
+	}
+	utl.INFO(r.RemoteAddr, "admin", "token issued for", body.User, ttl)
+	writeJSON(w, r, http.StatusOK, struct {
+		Token   string
+		Expires time.Time
+	}{auth.Sign(a.secret, body.User, ttl), time.Now().Add(ttl).Truncate(time.Second)})
+}
+
+// POST /admin/announcements
+func (a *api) serveAnnouncements(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	body := struct {
+		Text, Level string
+		conn.Target
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Text == "" {
+		writeError(w, r, http.StatusBadRequest, `Expected body {"Text":<text>,"Level":<level>,"Users":[..],"Tags":[..]}`)
+		return
+	}
+	instances, err := conn.Announce(body.Text, body.Level, body.Target)
+	if err != nil {
+		writeError(w, r, http.StatusBadGateway, err.Error())
+		return
+	}
+	utl.INFO(r.RemoteAddr, "admin", "announcement to", instances, "instances", body.Target)
+	writeJSON(w, r, http.StatusAccepted, struct{ Instances int }{instances})
+}
+
+///////////////////
+//HELPER FUNCTIONS
+
+func writeJSON(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(utl.JSON(v))
+	requests.Inc(r.Method, strconv.Itoa(code))
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	http.Error(w, msg, code)
+	requests.Inc(r.Method, strconv.Itoa(code))
+}
@@ -0,0 +1,77 @@
+// auth package issues and verifies user tokens of websocket clients
+//
+// token is "{payload}.{signature}", both base64url: payload is "{user}|{unix expiry}",
+// signature is HMAC-SHA256 of payload with auth secret shared by all weblayer instances.
+// client sends it as Authorization: Bearer {token} or ?access_token={token}
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// query parameter of token - browsers cannot set headers on websocket
+const QueryParam = "access_token"
+
+var (
+	ErrInvalid = errors.New("invalid token")
+	ErrExpired = errors.New("token expired")
+)
+
+var encoding = base64.RawURLEncoding
+
+//token of user valid for ttl
+func Sign(secret, user string, ttl time.Duration) string {
+	payload := fmt.Sprintf("%s|%d", user, time.Now().Add(ttl).Unix())
+	return encoding.EncodeToString([]byte(payload)) + "." + encoding.EncodeToString(mac(secret, payload))
+}
+
+//user of token - error when signature does not match or token expired
+func Verify(secret, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", ErrInvalid
+	}
+	payload, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrInvalid
+	}
+	sig, err := encoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, mac(secret, string(payload))) {
+		return "", ErrInvalid
+	}
+
+	sep := strings.LastIndexByte(string(payload), '|')
+	if sep <= 0 {
+		return "", ErrInvalid
+	}
+	expiry, err := strconv.ParseInt(string(payload[sep+1:]), 10, 64)
+	if err != nil {
+		return "", ErrInvalid
+	}
+	if time.Now().Unix() > expiry {
+		return "", ErrExpired
+	}
+	return string(payload[:sep]), nil
+}
+
+//token of request - "" when client sent none
+func FromRequest(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return r.URL.Query().Get(QueryParam)
+}
+
+func mac(secret, payload string) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
@@ -0,0 +1,216 @@
+package conn
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+	"workerlayer/metrics"
+	"workerlayer/utl"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+)
+
+//////////////////////////////////////////////////////
+// admin commands to every weblayer instance
+//
+// admin API does not know which instance holds a connection, so commands are published
+// on weblayer.admin - router of every instance is subscribed on it. each instance runs the
+// command on its own registry and replies on worker.{reply id}, the same way worker replies
+// to REST requests. PUBLISH returns number of instances that got the command, so caller
+// knows how many replies to wait for - except in cluster mode, where PUBLISH counts only
+// subscribers on one node and caller waits until timeout.
+//
+//	admin API --PUBLISH weblayer.admin--> every router --> List/Kick on own registry
+//	          <--worker.{reply id}------- reply of every instance
+
+const (
+	adminList = "list"
+	adminKick = "kick"
+)
+
+var adminCommands = metrics.NewCounter("weblayer_admin_commands_total", "Admin commands run on this instance, by command.", "cmd")
+
+//name of this instance in admin replies
+var node = nodeName()
+
+//live connection as seen by admin API
+type Info struct {
+	ID         string
+	Node       string
+	RemoteAddr string
+	//peer of websocket when client came through proxy
+	ProxyAddr   string `json:",omitempty"`
+	Path        string
+	User        string
+	Tags        []string `json:",omitempty"`
+	ConnectedAt time.Time
+	MessagesIn  int64
+	MessagesOut int64
+}
+
+type adminCommand struct {
+	Cmd string
+	//connection of kick
+	ID string
+	//reply goes to worker.{ReplyTo}
+	ReplyTo string
+}
+
+type adminReply struct {
+	Node        string
+	Connections []Info `json:",omitempty"`
+	Kicked      bool   `json:",omitempty"`
+}
+
+func nodeName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "weblayer"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+//connections of this instance, oldest first
+func List() []Info {
+	connmux.Lock()
+	list := make([]Info, 0, len(connections))
+	for _, c := range connections {
+		list = append(list, c.info())
+	}
+	connmux.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ConnectedAt.Before(list[j].ConnectedAt) })
+	return list
+}
+
+func (c *Connection) info() Info {
+	return Info{
+		ID:          c.id,
+		Node:        node,
+		RemoteAddr:  c.RemoteAddr(),
+		ProxyAddr:   c.proxyAddr(),
+		Path:        c.path,
+		User:        c.user,
+		Tags:        c.tags,
+		ConnectedAt: c.connectedAt,
+		MessagesIn:  atomic.LoadInt64(&c.messagesIn),
+		MessagesOut: atomic.LoadInt64(&c.messagesOut),
+	}
+}
+
+func (c *Connection) proxyAddr() string {
+	if c.clientAddr == "" {
+		return ""
+	}
+	return c.ws.RemoteAddr().String()
+}
+
+//close connection of this instance through its Close channel - false when there is no such connection
+func Kick(id string) bool {
+	connmux.Lock()
+	c, exists := connections[id]
+	connmux.Unlock()
+	if !exists {
+		return false
+	}
+	c.log().INFO("admin", "kick", id, c.userName())
+	select {
+	case c.Close <- true:
+	default:
+	}
+	return true
+}
+
+//connections of all instances that replied within timeout
+func ListAll(timeout time.Duration) ([]Info, error) {
+	list := []Info{}
+	err := adminCall(adminCommand{Cmd: adminList}, timeout, func(rp adminReply) bool {
+		list = append(list, rp.Connections...)
+		return false
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].ConnectedAt.Before(list[j].ConnectedAt) })
+	return list, err
+}
+
+//kick connection on whichever instance holds it - false when no instance has it
+func KickAll(id string, timeout time.Duration) (bool, error) {
+	kicked := false
+	err := adminCall(adminCommand{Cmd: adminKick, ID: id}, timeout, func(rp adminReply) bool {
+		kicked = rp.Kicked
+		return kicked
+	})
+	return kicked, err
+}
+
+//publish command to every instance and pass replies to collect until it returns true,
+//all instances replied or timeout expired
+func adminCall(cmd adminCommand, timeout time.Duration, collect func(adminReply) bool) error {
+	cmd.ReplyTo = uuid.New()
+	sub, err := Subscribe(cmd.ReplyTo)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	rc := Pool.Get()
+	instances, err := redis.Int(rc.Do("PUBLISH", adminChannel, utl.JSON(cmd)))
+	rc.Close()
+	if err != nil {
+		utl.ERR("admin", "PUBLISH", err)
+		return err
+	}
+
+	deadline := time.After(timeout)
+	for replies := 0; clusterMode || replies < instances; replies++ {
+		select {
+		case m := <-sub.C:
+			rp := adminReply{}
+			if err := json.Unmarshal(m, &rp); err != nil {
+				utl.WARN("admin", "invalid reply", string(m))
+				continue
+			}
+			if collect(rp) {
+				return nil
+			}
+		case <-sub.Done():
+			utl.WARN("admin", cmd.Cmd, "got", replies, "of", instances, "replies")
+			return ErrSubscriptionClosed
+		case <-deadline:
+			if !clusterMode {
+				utl.WARN("admin", cmd.Cmd, "got", replies, "of", instances, "replies")
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+//run command from weblayer.admin on this instance and reply
+func onAdmin(m []byte) {
+	cmd := adminCommand{}
+	if err := json.Unmarshal(m, &cmd); err != nil || cmd.ReplyTo == "" {
+		utl.WARN("admin", "invalid command", string(m))
+		return
+	}
+
+	rp := adminReply{Node: node}
+	switch cmd.Cmd {
+	case adminList:
+		rp.Connections = List()
+	case adminKick:
+		rp.Kicked = Kick(cmd.ID)
+	default:
+		utl.WARN("admin", "unknown command", cmd.Cmd)
+		return
+	}
+	adminCommands.Inc(cmd.Cmd)
+
+	rc := Pool.Get()
+	defer rc.Close()
+	if _, err := rc.Do("PUBLISH", fmt.Sprintf("worker.%s", cmd.ReplyTo), utl.JSON(rp)); err != nil {
+		utl.ERR("admin", "reply", err)
+	}
+}
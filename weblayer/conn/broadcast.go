@@ -0,0 +1,103 @@
+package conn
+
+import (
+	"encoding/json"
+	"workerlayer/messages"
+	"workerlayer/metrics"
+	"workerlayer/utl"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//////////////////////////////////////////////////////
+// announcements to connected clients
+//
+// admin API publishes announcement with its target on weblayer.broadcast - router of every
+// instance is subscribed on it and fans SrvAnnouncement out to outboxes of matching
+// connections. target without users and tags matches every connection.
+
+var announcements = metrics.NewCounter("weblayer_announcements_total", "Announcements queued to connections of this instance.")
+
+//connections an announcement goes to - connection matches when its user or one of its tags is listed
+type Target struct {
+	Users []string `json:",omitempty"`
+	Tags  []string `json:",omitempty"`
+}
+
+type broadcast struct {
+	Target  Target
+	Message messages.Announcement
+}
+
+//publish announcement to every weblayer instance - returns number of instances that got it
+//(in cluster mode only instances subscribed on the node that got PUBLISH are counted)
+func Announce(text, level string, target Target) (int, error) {
+	m := messages.Announcement{
+		Reply: messages.Reply{Cmd: messages.SrvAnnouncement, Status: messages.StatusOK},
+		Text:  text,
+		Level: level,
+	}
+	rc := Pool.Get()
+	defer rc.Close()
+	instances, err := redis.Int(rc.Do("PUBLISH", broadcastChannel, utl.JSON(broadcast{Target: target, Message: m})))
+	if err != nil {
+		utl.ERR("announce", "PUBLISH", err)
+	}
+	return instances, err
+}
+
+//empty target matches all connections
+func (t Target) matches(c *Connection) bool {
+	if len(t.Users) == 0 && len(t.Tags) == 0 {
+		return true
+	}
+	if c.user != "" && contains(t.Users, c.user) {
+		return true
+	}
+	for _, tag := range c.tags {
+		if contains(t.Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+//queue announcement from weblayer.broadcast to matching connections of this instance
+func onBroadcast(m []byte) {
+	b := broadcast{}
+	if err := json.Unmarshal(m, &b); err != nil {
+		utl.WARN("broadcast", "invalid message", string(m))
+		return
+	}
+	n := fanOut(utl.JSON(b.Message), b.Target.matches)
+	announcements.Add(float64(n))
+	utl.INFO("broadcast", "announcement queued to", n, "connections")
+}
+
+//queue message to outbox of every matching connection of this instance - like messages from worker,
+//it never waits for connection, slow consumer is disconnected
+//returns number of matching connections
+func fanOut(m []byte, match func(*Connection) bool) int {
+	connmux.Lock()
+	var targets []*Connection
+	for _, c := range connections {
+		if match(c) {
+			targets = append(targets, c)
+		}
+	}
+	connmux.Unlock()
+
+	for _, c := range targets {
+		c.deliver(m)
+	}
+	return len(targets)
+}
@@ -9,10 +9,13 @@ package conn
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
+	"weblayer/proxy"
+	"workerlayer/messages"
+	"workerlayer/presence"
 	"workerlayer/utl"
 
-	"github.com/garyburd/redigo/redis"
 	"github.com/gorilla/websocket"
 	"github.com/pborman/uuid"
 )
@@ -31,10 +34,10 @@ import (
 //  (read from web socket)		    (write to websocket)
 //               |                       |
 //               |                       |
-//               | (reader chan)         | (writer chan)
+//               | (reader chan)         | (outbox)
 //               |                       |
 //               |->     controller() --
-// 		(get messages from other routines, send message to write routine, read messages from read routine)
+// 		(get messages from other routines, queue message for write routine, read messages from read routine)
 //                       / \
 //                      | c |
 //                      | h |
@@ -43,9 +46,10 @@ import (
 //                       \ /
 // 				 *other go routines*
 //				- through c.Send channel send msg to client
-//				- through hub.hubchannel channel get msg from client
+//				- router queues msg from worker to outbox directly
 //
 
+//defaults of Options - deployment and endpoints can override them
 const (
 	// time period for auth check
 	authWait = 10 * time.Second
@@ -57,25 +61,44 @@ const (
 	// Time allowed to read the next pong message from the peer.
 	pongWait = 600 * time.Second
 
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 7) / 10
-
 	// Maximum message size allowed from peer.
 	maxMessageSize = 1024 * 15
 )
 
 //wrapper over websocket
 type Connection struct {
+	//messages from and to client - first in struct for 64-bit alignment of atomic access
+	messagesIn  int64
+	messagesOut int64
+
 	// The websocket connection.
 	ws *websocket.Conn
 	//uuid
 	id string
-
-	//connection subscribed on redis channel for this websocket connection
-	psc redis.PubSubConn
+	//authenticated user, "" for anonymous
+	user string
+	//labels client gave on connect - announcements can target them
+	tags []string
+	//address of client resolved by hub - "" when same as websocket peer
+	clientAddr string
+	//traceparent of upgrade request - parent of requests that do not carry their own
+	traceParent string
+	//websocket path connection came to
+	path        string
+	connectedAt time.Time
+
+	//timeouts and limits of endpoint connection came from
+	opts Options
+
+	//resumable session of connection
+	sess *session
+
+	//bounded queue of outbound messages - filled by router and controller, drained by write goroutine
+	out *outbox
 
 	//controller helper channels
 	reader chan []byte
+	//closed by controller to stop write goroutine
 	writer chan []byte
 
 	//channels for read or write go routine to notify controller
@@ -95,13 +118,13 @@ type Connection struct {
 //read pumps messages from the websocket connection to the controller.
 func (c *Connection) read() {
 
-	msg := fmt.Sprintf("conn.read() %v %v", c.RemoteAddr(), "anonymous")
+	msg := fmt.Sprintf("conn.read() %v %v", c.RemoteAddr(), c.userName())
 	defer utl.HandleDefer(msg, time.Now(), nil)
 
 	for {
 		_, message, err := c.ws.ReadMessage()
 		if err != nil {
-			utl.WARN(c.RemoteAddr(), "read", err.Error())
+			c.log().WARN("read", err.Error())
 			//notify controller
 			c.readerror <- err
 			return //this exits go routine
@@ -113,35 +136,51 @@ func (c *Connection) read() {
 
 // write writes a message with the given message type and payload.
 func (c *Connection) writeSocket(mt int, payload []byte) error {
-	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	c.ws.SetWriteDeadline(time.Now().Add(c.opts.WriteWait))
 	return c.ws.WriteMessage(mt, payload)
 }
 
 // write pumps messages from the controller to the websocket connection.
 func (c *Connection) write() {
-	msg := fmt.Sprintf("conn.write() %v %v", c.RemoteAddr(), "anonymous")
+	msg := fmt.Sprintf("conn.write() %v %v", c.RemoteAddr(), c.userName())
 	defer utl.HandleDefer(msg, time.Now(), nil)
 
 	for {
 		select {
-		//controller sends message
-		case message, ok := <-c.writer:
+		//controller stops writer
+		case _, ok := <-c.writer:
 			if !ok {
-				utl.INFO(c.ws.RemoteAddr().String(), "write", "send message channell - NOTOK!")
+				c.log().INFO("write", "send message channell - NOTOK!")
 				return //this will call defer block
 			}
 
-			if err := c.writeSocket(websocket.BinaryMessage, message); err != nil {
-				utl.WARN(c.ws.RemoteAddr().String(), "write", "write socket not OK.", err.Error())
-				c.writeerror <- err
-				return
+		//messages queued in outbox
+		case <-c.out.ready:
+			for {
+				e, push, ok := c.out.take()
+				if !ok {
+					break
+				}
+				message := e.m
+				if err := c.writeSocket(websocket.BinaryMessage, message); err != nil {
+					c.log().WARN("write", "write socket not OK.", err.Error())
+					c.writeerror <- err
+					return
+				}
+				//only lists client really got - resumed session replays the rest
+				if push {
+					c.sess.advance(e.seq)
+				}
+				atomic.AddInt64(&c.messagesOut, 1)
+				messagesOut.Inc(replyLabel(message))
+				bytesSent.Add(float64(len(message)))
 			}
 
 		//controller sends ping to client
 		case <-c.pinger:
 			//utl.Log(c.ws.RemoteAddr().String(),  "write", "Sending message PING")
 			if err := c.writeSocket(websocket.PingMessage, []byte{}); err != nil {
-				utl.WARN(c.ws.RemoteAddr().String(), "write", "pinger sending ping failed. ", err.Error())
+				c.log().WARN("write", "pinger sending ping failed. ", err.Error())
 				c.writeerror <- err
 				return
 			}
@@ -157,25 +196,34 @@ func (c *Connection) write() {
 func (c *Connection) controller() {
 	//tickers
 
-	pinger := time.NewTicker(pingPeriod)
+	pinger := time.NewTicker(c.opts.pingPeriod())
+	saver := time.NewTicker(sessionSync)
+	beat := time.NewTicker(presence.Heartbeat)
 	delay := &time.Ticker{}
 
 	defer func() {
 		if r := recover(); r != nil {
 			utl.LogRecover("controller", r)
 		}
+		//remove route of worker.{connid} from router
+		unroute(c.id)
 		//close websocket
 		c.ws.Close()
 		//stop tickers
 		pinger.Stop()
+		saver.Stop()
+		beat.Stop()
+		//user goes offline with last connection
+		c.leavePresence()
+		//session TTL starts now - includes pushes queued during delay
+		c.sess.save()
 		delay.Stop()
 		// notify worker that client websocket is closed
-		c.sendToRedis([]byte("closed"))
-		utl.INFO("After send to tredis")
-		//unsubscribe conn from redis
-		c.psc.Unsubscribe(fmt.Sprintf("worker.%s", c.id))
+		c.sendToRedis([]byte(messages.ClosedMessage))
 
-		utl.INFO(c.RemoteAddr(), "exiting connection controller - end of connection go routines")
+		c.log().INFO("exiting connection controller - end of connection go routines")
+		//remove from registry - shutdown waits for this
+		unregister(c)
 	}()
 
 	closed := false
@@ -185,43 +233,58 @@ func (c *Connection) controller() {
 		select {
 
 		case message := <-c.Send:
-			//send message to client through write go routine
+			//queue message for write go routine
 			if !closed {
-				c.writer <- message
+				c.deliver(message)
 			}
 		case <-c.Close:
 			if !closed {
-				utl.INFO(c.ws.RemoteAddr().String(), "connController", "forced closing connection.")
+				c.log().INFO("connController", "forced closing connection.")
 				//closing socket will cause exiting of read/write pump go routines through helper channels
 				CloseWS(c)
 				closed = true
-				delay = time.NewTicker(connDelay)
+				c.sess.save()
+				delay = time.NewTicker(c.opts.ConnDelay)
 			}
 
 		case msg := <-c.reader:
 			//reader got message from client - send to worker over redis
 			if !closed {
-				c.sendToRedis(msg)
+				atomic.AddInt64(&c.messagesIn, 1)
+				messagesIn.Inc(requestLabel(msg))
+				msg, span := startRequest(msg, c.traceParent, map[string]string{"conn_id": c.id})
+				span.SetError(c.sendToRedis(msg))
+				span.End()
 			}
 		case <-pinger.C:
 			if !closed {
 				c.pinger <- true
 			}
+		case <-saver.C:
+			c.sess.save()
+		case <-beat.C:
+			if !closed {
+				c.touchPresence()
+			}
 		case <-c.writeerror:
 			if !closed {
 				//stop reader pump when writer is stopped
 				CloseWS(c)
 				closed = true
+				//client may reconnect before controller exits
+				c.sess.save()
 				//delay of exit for eventual messages from other goroutines that use c.Send and c.Auth channels
-				delay = time.NewTicker(connDelay)
+				delay = time.NewTicker(c.opts.ConnDelay)
 			}
 		case <-c.readerror:
 			if !closed {
 				//stop writer pump whe reader is stopped
 				closed = true
 				close(c.writer)
+				//client may reconnect before controller exits
+				c.sess.save()
 				//delay of exit for eventual messages from other goroutines that use c.Send and c.Auth channels
-				delay = time.NewTicker(connDelay)
+				delay = time.NewTicker(c.opts.ConnDelay)
 			}
 		case <-delay.C:
 			//exiting connection controller
@@ -231,28 +294,74 @@ func (c *Connection) controller() {
 
 }
 
+//queue message for client - called by router for every message from worker
+//never blocks, client that does not read fast enough is disconnected
+func (c *Connection) deliver(m []byte) {
+	span := startDelivery(m, c.id)
+	defer span.End()
+	seq, push := pushSeq(m)
+	if push && c.sess.sent(seq) {
+		//client already has this list (replay after resume)
+		droppedMessages.Inc("duplicate")
+		span.SetAttr("dropped", "duplicate")
+		return
+	}
+	switch c.out.put(m, seq, push) {
+	case coalesced:
+		droppedMessages.Inc("coalesced")
+		span.SetAttr("dropped", "coalesced")
+	case dropped:
+		droppedMessages.Inc("queue_full")
+		span.SetAttr("dropped", "queue_full")
+	case slow:
+		droppedMessages.Inc("slow_consumer")
+		span.SetAttr("dropped", "slow_consumer")
+		slowConsumers.Inc()
+		c.log().WARN("deliver", "slow consumer - closing connection")
+		select {
+		case c.Close <- true:
+		default:
+		}
+	}
+}
+
 ///////////////////
 //HELPER FUNCTIONS
 
 //send close signal to client
 func CloseWS(c *Connection) {
-	utl.INFO(c.ws.RemoteAddr().String(), "closeWS", "closing websocket connection.")
+	c.log().INFO("closeWS", "closing websocket connection.")
 	c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Server forced closed connection."), time.Now().Add(time.Second))
 }
 
-//helper for address of conection
+//helper for address of conection - real client behind trusted proxies
 func (c *Connection) RemoteAddr() string {
-	//return c.ws.RemoteAddr().String()
-	return fmt.Sprintf("%s", c.ws.RemoteAddr().String())
+	if c.clientAddr != "" {
+		return c.clientAddr
+	}
+	return c.ws.RemoteAddr().String()
+}
+
+//logger with id and address of connection
+func (c *Connection) log() utl.Logger {
+	return utl.With(utl.Fields{ConnID: c.id, RemoteAddr: c.RemoteAddr()})
+}
+
+//user for logs
+func (c *Connection) userName() string {
+	if c.user == "" {
+		return "anonymous"
+	}
+	return c.user
 }
 
 //set websocket options and PONG handler
 func (c *Connection) wsOptions() {
-	c.ws.SetReadLimit(maxMessageSize)
-	c.ws.SetReadDeadline(time.Now().Add(pongWait))
+	c.ws.SetReadLimit(c.opts.MaxMessageSize)
+	c.ws.SetReadDeadline(time.Now().Add(c.opts.PongWait))
 	c.ws.SetPongHandler(
 		func(string) error {
-			c.ws.SetReadDeadline(time.Now().Add(pongWait))
+			c.ws.SetReadDeadline(time.Now().Add(c.opts.PongWait))
 			return nil
 		})
 }
@@ -260,13 +369,42 @@ func (c *Connection) wsOptions() {
 /////////////////////////////////////////////
 ////// starter function - connection factory
 /////////////////////////////////////////////
+
+//what hub knows about connection from upgrade request
+type Params struct {
+	//timeouts and limits of endpoint
+	Options Options
+	//websocket path of endpoint
+	Path string
+	//resumes session of previous connection
+	Token string
+	//stored in session
+	Prefs map[string]string
+	//authenticated user, "" for anonymous
+	User string
+	//labels for targeted announcements
+	Tags []string
+	//push topics to add to session, e.g. presence
+	Subscribe []string
+	//address of client resolved through trusted proxies
+	ClientAddr string
+	//traceparent header of upgrade request
+	TraceParent string
+}
+
 //create new connection, initialize channles, starts goroutines
-func StartConnection(ws *websocket.Conn) {
+func StartConnection(ws *websocket.Conn, p Params) {
 
-	c := &Connection{ws: ws}
+	c := &Connection{ws: ws, opts: p.Options, user: p.User, tags: p.Tags, path: p.Path, connectedAt: time.Now(), traceParent: p.TraceParent}
+	if p.ClientAddr != proxy.IP(ws.RemoteAddr().String()) {
+		c.clientAddr = p.ClientAddr
+	}
 
 	c.id = uuid.New()
 	c.Send = make(chan []byte)
+	c.out = newOutbox()
+	//buffered so CloseAll never blocks on controller that is exiting
+	c.Close = make(chan bool, 1)
 
 	c.reader = make(chan []byte)
 	c.writer = make(chan []byte)
@@ -276,18 +414,45 @@ func StartConnection(ws *websocket.Conn) {
 	c.readerror = make(chan error)
 	c.writeerror = make(chan error)
 
+	//restore or create session - before register, fan-out of registered connections reads it
+	var resumed bool
+	c.sess, resumed = openSession(p.Token, p.User, p.Prefs, p.Subscribe)
+
+	//server is shutting down - refuse connection
+	if !register(c) {
+		CloseWS(c)
+		ws.Close()
+		return
+	}
+
+	//token is first message client gets
+	c.sess.save()
+	c.out.put(c.sess.message(resumed), 0, false)
+
 	//setup read options
 	c.wsOptions()
 	//start two go routines to read and write separatley
 	go c.write()
 	go c.read()
+	//route messages from worker.{connid} to c.Send - before init so first push is not missed
+	if err := route(c.id, c.deliver); err != nil {
+		//no way to get replies from worker - controller closes connection
+		c.log().ERR("route", err)
+		c.Close <- true
+	}
+	//online before controller - its heartbeats refresh presence
+	c.touchPresence()
 	//controller controlls message flow and lifecycle through read and write goroutines
 	go c.controller()
 
-	//start redis routine to catch message from worker
-	go c.readWorkerMessages()
-	//special command
-	c.sendToRedis([]byte("init"))
+	//special command - worker learns who is on the other side
+	info := messages.ConnInfo{ClientIP: proxy.IP(c.RemoteAddr()), User: c.user}
+	c.sendToRedis(append([]byte(messages.InitMessage+" "), utl.JSON(info)...))
+	//replay - current list is delivered only if it changed since last one session got
+	if resumed {
+		c.sendToRedis(utl.JSON(messages.ClientGetList{ClientRQ: messages.ClientRQ{Cmd: messages.RQListAllUsers}}))
+	}
 	//new connection - send stat
-	utl.INFO("connection++")
+	connectionsTotal.Inc()
+	c.log().INFO("connection++", c.userName())
 }
@@ -0,0 +1,38 @@
+package conn
+
+import (
+	"encoding/json"
+	"workerlayer/messages"
+	"workerlayer/metrics"
+)
+
+////////////////////////
+// weblayer metrics
+
+var (
+	_ = metrics.NewGaugeFunc("weblayer_connections_active", "Websocket connections currently open.",
+		func() float64 { return float64(Count()) })
+	connectionsTotal = metrics.NewCounter("weblayer_connections_total", "Websocket connections accepted.")
+	messagesIn       = metrics.NewCounter("weblayer_messages_in_total", "Messages received from clients, by command.", "cmd")
+	messagesOut      = metrics.NewCounter("weblayer_messages_out_total", "Messages sent to clients, by reply type.", "cmd")
+	bytesSent        = metrics.NewCounter("weblayer_bytes_sent_total", "Bytes written to websockets.")
+	publishSeconds   = metrics.NewHistogram("weblayer_redis_publish_seconds", "Latency of PUBLISH to worker.", metrics.DefBuckets)
+)
+
+//command name of client request - used as metric label
+func requestLabel(m []byte) string {
+	rq := messages.ClientRQ{}
+	if err := json.Unmarshal(m, &rq); err != nil {
+		return "invalid"
+	}
+	return rq.Cmd.String()
+}
+
+//reply type of worker message - used as metric label
+func replyLabel(m []byte) string {
+	rp := messages.Reply{}
+	if err := json.Unmarshal(m, &rp); err != nil {
+		return "raw"
+	}
+	return rp.Cmd.String()
+}
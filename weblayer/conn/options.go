@@ -0,0 +1,122 @@
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////////////////////////////////////////////////////
+// Options - timeouts and limits of websocket connection
+//
+// defaults are constants from conn.go, deployment changes them in config
+// and every websocket path can override them, e.g. for mobile clients:
+//
+//	/ws/mobile:ping-period=25s,pong-wait=60s
+
+type Options struct {
+	// Time allowed to write a message to the peer.
+	WriteWait time.Duration
+	// Time allowed to read the next pong message from the peer.
+	PongWait time.Duration
+	// Send pings to peer with this period. Must be less than PongWait, 0 means 7/10 of PongWait.
+	PingPeriod time.Duration
+	// delay ending of connection - for eventual messages from other routines before exiting
+	ConnDelay time.Duration
+	// Maximum message size allowed from peer.
+	MaxMessageSize int64
+}
+
+//options with compiled in defaults
+func DefaultOptions() Options {
+	return Options{
+		WriteWait:      writeWait,
+		PongWait:       pongWait,
+		ConnDelay:      connDelay,
+		MaxMessageSize: maxMessageSize,
+	}
+}
+
+//set one option by key (write-wait, pong-wait, ping-period, conn-delay, max-message-size), durations are in time.ParseDuration format
+func (o *Options) Set(key, value string) error {
+	if key == "max-message-size" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		o.MaxMessageSize = n
+		return nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	switch key {
+	case "write-wait":
+		o.WriteWait = d
+	case "pong-wait":
+		o.PongWait = d
+	case "ping-period":
+		o.PingPeriod = d
+	case "conn-delay":
+		o.ConnDelay = d
+	default:
+		return fmt.Errorf("unknown option %q", key)
+	}
+	return nil
+}
+
+//error when options can't work together
+func (o Options) Validate() error {
+	if o.WriteWait <= 0 || o.PongWait <= 0 || o.ConnDelay <= 0 || o.PingPeriod < 0 {
+		return errors.New("timeouts must be positive")
+	}
+	if o.MaxMessageSize <= 0 {
+		return errors.New("max-message-size must be positive")
+	}
+	if o.pingPeriod() >= o.PongWait {
+		return fmt.Errorf("ping-period %v must be less than pong-wait %v", o.pingPeriod(), o.PongWait)
+	}
+	return nil
+}
+
+//ping period, derived from PongWait when not set
+func (o Options) pingPeriod() time.Duration {
+	if o.PingPeriod == 0 {
+		return (o.PongWait * 7) / 10
+	}
+	return o.PingPeriod
+}
+
+func (o Options) String() string {
+	return fmt.Sprintf("write-wait=%v pong-wait=%v ping-period=%v conn-delay=%v max-message-size=%d",
+		o.WriteWait, o.PongWait, o.pingPeriod(), o.ConnDelay, o.MaxMessageSize)
+}
+
+//parse endpoint override "path:key=value,key=value" on top of base options
+func ParseEndpoint(spec string, base Options) (string, Options, error) {
+	opts := base
+	path, overrides := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		path, overrides = spec[:i], spec[i+1:]
+	}
+	if !strings.HasPrefix(path, "/") {
+		return "", opts, fmt.Errorf("endpoint %q: path must start with /", spec)
+	}
+	for _, kv := range strings.Split(overrides, ",") {
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return "", opts, fmt.Errorf("endpoint %q: expected key=value, got %q", spec, kv)
+		}
+		if err := opts.Set(parts[0], parts[1]); err != nil {
+			return "", opts, fmt.Errorf("endpoint %q: %v", spec, err)
+		}
+	}
+	return path, opts, opts.Validate()
+}
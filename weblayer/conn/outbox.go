@@ -0,0 +1,146 @@
+package conn
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+	"workerlayer/messages"
+	"workerlayer/metrics"
+)
+
+//////////////////////////////////////////////////////
+// outbox - bounded outbound queue of connection
+//
+// router and c.Send put messages here without blocking, write go routine takes them
+// policy per message type:
+//   - user list push (SrvListAllUsers without RequestID) - coalesced, only latest push is kept
+//   - everything else (replies) - queued up to maxQueued, dropped when queue is full
+// connection whose queue is not drained empty for slowConsumerWait is disconnected - checked on every put,
+// so client that reads only a little or gets only pushes is caught too
+
+const (
+	// replies queued for one connection
+	maxQueued = 64
+	// consumer that does not empty its queue for this long is disconnected
+	slowConsumerWait = 10 * time.Second
+)
+
+var (
+	droppedMessages = metrics.NewCounter("weblayer_dropped_messages_total", "Messages to clients not sent, by reason.", "reason")
+	slowConsumers   = metrics.NewCounter("weblayer_slow_consumers_total", "Connections closed because client did not read fast enough.")
+)
+
+// result of put
+const (
+	queued = iota
+	coalesced
+	dropped
+	slow
+)
+
+//queued message - seq of user list push is written to session when push is sent
+type entry struct {
+	m   []byte
+	seq int64
+}
+
+type outbox struct {
+	mux   sync.Mutex
+	queue []entry
+	//index of queued user list push, -1 if none
+	push int
+	//time queue became non-empty after it was last drained, zero when empty
+	busySince time.Time
+	//slow consumer already reported - connection is closing
+	isSlow bool
+
+	//signal to write go routine that queue is not empty
+	ready chan bool
+}
+
+func newOutbox() *outbox {
+	return &outbox{push: -1, ready: make(chan bool, 1)}
+}
+
+//queue message according to its type - never blocks
+func (o *outbox) put(m []byte, seq int64, push bool) int {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	if o.isSlow {
+		//connection is closing
+		return dropped
+	}
+	if !o.busySince.IsZero() && time.Since(o.busySince) > slowConsumerWait {
+		o.isSlow = true
+		return slow
+	}
+	if len(o.queue) == 0 {
+		o.busySince = time.Now()
+	}
+
+	result := queued
+	switch {
+	case push && o.push >= 0:
+		//older push not sent yet - replace it with latest
+		if seq >= o.queue[o.push].seq {
+			o.queue[o.push] = entry{m: m, seq: seq}
+		}
+		result = coalesced
+	case push:
+		o.push = len(o.queue)
+		o.queue = append(o.queue, entry{m: m, seq: seq})
+	case o.replies() >= maxQueued:
+		return dropped
+	default:
+		o.queue = append(o.queue, entry{m: m})
+	}
+
+	select {
+	case o.ready <- true:
+	default:
+	}
+	return result
+}
+
+//next message to write and true if it is user list push, false when queue is empty
+func (o *outbox) take() (entry, bool, bool) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	if len(o.queue) == 0 {
+		return entry{}, false, false
+	}
+	e := o.queue[0]
+	o.queue[0] = entry{}
+	o.queue = o.queue[1:]
+	push := o.push == 0
+	o.push--
+	if o.push < 0 {
+		o.push = -1
+	}
+	if len(o.queue) == 0 {
+		o.busySince = time.Time{}
+	}
+	return e, push, true
+}
+
+//queued messages except push - caller holds o.mux
+func (o *outbox) replies() int {
+	if o.push >= 0 {
+		return len(o.queue) - 1
+	}
+	return len(o.queue)
+}
+
+//user list pushed on key change and its Seq - replies to list request carry RequestID
+func pushSeq(m []byte) (int64, bool) {
+	rp := struct {
+		messages.Reply
+		Seq int64
+	}{}
+	if err := json.Unmarshal(m, &rp); err != nil {
+		return 0, false
+	}
+	return rp.Seq, rp.Cmd == messages.SrvListAllUsers && rp.RequestID == ""
+}
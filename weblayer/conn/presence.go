@@ -0,0 +1,85 @@
+package conn
+
+import (
+	"encoding/json"
+	"time"
+	"workerlayer/messages"
+	"workerlayer/metrics"
+	"workerlayer/presence"
+	"workerlayer/utl"
+)
+
+//////////////////////////////////////////////////////
+// presence of connections - see workerlayer/presence for key layout
+//
+// controller touches presence entries of its connection on start and every presence.Heartbeat
+// and removes them on exit. when user comes online or goes offline, join/leave is published on
+// presence.events - router of every instance fans it out to connections whose session is
+// subscribed on presence. sweeper reports leave of users whose instance crashed.
+
+var presenceEvents = metrics.NewCounter("weblayer_presence_events_total", "Presence events published by this instance, by event.", "event")
+
+//start sweeper go routine - runs for lifetime of process
+func StartPresence() {
+	go func() {
+		for range time.Tick(presence.Heartbeat) {
+			gone, err := presence.Sweep(Pool)
+			if err != nil {
+				utl.ERR("presence", "sweep", err)
+				continue
+			}
+			for _, user := range gone {
+				utl.INFO("presence", "heartbeat expired", user)
+				publishPresence(user, messages.PresenceLeave)
+			}
+		}
+	}()
+}
+
+//create or refresh presence of connection
+func (c *Connection) touchPresence() {
+	joined, err := presence.Touch(Pool, c.id, c.user)
+	if err != nil {
+		c.log().ERR("presence", err)
+		return
+	}
+	if joined {
+		publishPresence(c.user, messages.PresenceJoin)
+	}
+}
+
+//remove presence of closed connection
+func (c *Connection) leavePresence() {
+	left, err := presence.Leave(Pool, c.id, c.user)
+	if err != nil {
+		c.log().ERR("presence", err)
+		return
+	}
+	if left {
+		publishPresence(c.user, messages.PresenceLeave)
+	}
+}
+
+func publishPresence(user, event string) {
+	m := messages.Presence{
+		Reply: messages.Reply{Cmd: messages.SrvPresence, Status: messages.StatusOK},
+		User:  user,
+		Event: event,
+	}
+	rc := Pool.Get()
+	defer rc.Close()
+	if _, err := rc.Do("PUBLISH", presence.Channel, utl.JSON(m)); err != nil {
+		utl.ERR("presence", "PUBLISH", err)
+		return
+	}
+	presenceEvents.Inc(event)
+}
+
+//queue presence event to subscribed connections of this instance
+func onPresence(m []byte) {
+	if err := json.Unmarshal(m, &messages.Presence{}); err != nil {
+		utl.WARN("presence", "invalid event", string(m))
+		return
+	}
+	fanOut(m, func(c *Connection) bool { return c.sess.subscribed(presence.Topic) })
+}
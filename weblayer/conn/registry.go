@@ -0,0 +1,105 @@
+package conn
+
+import (
+	"sync"
+	"time"
+	"workerlayer/utl"
+)
+
+//////////////////////////////////////////////////////
+// registry of live connections
+//
+// every connection started with StartConnection is registered here until its controller exits
+// used on shutdown to close all websockets and wait for controllers to finish
+
+var (
+	connections = make(map[string]*Connection)
+	connmux     sync.Mutex
+	//one entry per running controller goroutine
+	controllers sync.WaitGroup
+	//set when shutdown started - no new connections are accepted
+	shuttingDown bool
+	//closed when shutdown started - streams without websocket (SSE) end on it
+	stopping = make(chan bool)
+)
+
+//add connection to registry
+func register(c *Connection) bool {
+	connmux.Lock()
+	defer connmux.Unlock()
+	if shuttingDown {
+		return false
+	}
+	connections[c.id] = c
+	controllers.Add(1)
+	return true
+}
+
+//remove connection from registry - called by controller on exit
+func unregister(c *Connection) {
+	connmux.Lock()
+	delete(connections, c.id)
+	connmux.Unlock()
+	controllers.Done()
+}
+
+//true when shutdown is in progress
+func ShuttingDown() bool {
+	connmux.Lock()
+	defer connmux.Unlock()
+	return shuttingDown
+}
+
+//closed when shutdown starts
+func Stopping() <-chan bool {
+	return stopping
+}
+
+//refuse new connections and end streams - websockets are closed by CloseAll
+func BeginShutdown() {
+	connmux.Lock()
+	defer connmux.Unlock()
+	if !shuttingDown {
+		shuttingDown = true
+		close(stopping)
+	}
+}
+
+//number of active connections
+func Count() int {
+	connmux.Lock()
+	defer connmux.Unlock()
+	return len(connections)
+}
+
+//close every registered connection through its Close channel
+//and wait for all controller go routines to finish, at most timeout
+//returns false if timeout expired before all controllers exited
+func CloseAll(timeout time.Duration) bool {
+	BeginShutdown()
+	connmux.Lock()
+	for _, c := range connections {
+		//Close is buffered - never block on controller that is already exiting
+		select {
+		case c.Close <- true:
+		default:
+		}
+	}
+	utl.INFO("closing", len(connections), "connections")
+	connmux.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		controllers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		utl.INFO("all connection controllers finished")
+		return true
+	case <-time.After(timeout):
+		utl.WARN("CloseAll", "timeout waiting for connection controllers", Count(), "still running")
+		return false
+	}
+}
@@ -0,0 +1,59 @@
+package conn
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+	"workerlayer/messages"
+	"workerlayer/utl"
+)
+
+//////////////////////////////////////////////////////
+// one-off request/response to worker without websocket
+//
+// same path as websocket traffic: request is published on conn.{id}, reply comes on worker.{id}
+// id is RequestID of request, so it must be unique (uuid) - reply is matched by it
+
+var (
+	ErrTimeout   = errors.New("timeout waiting for worker reply")
+	ErrNoRequest = errors.New("request without RequestID")
+)
+
+//send request to worker and wait for reply with same RequestID
+//returns raw JSON of reply
+func Request(rq messages.ClientRequest, timeout time.Duration) ([]byte, error) {
+	id := rq.ID()
+	if id == "" {
+		return nil, ErrNoRequest
+	}
+
+	sub, err := Subscribe(id)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Close()
+
+	m, span := startRequest(utl.JSON(rq), "", map[string]string{"transport": "rest"})
+	defer span.End()
+	if err := publish(id, m); err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case m := <-sub.C:
+			rp := messages.Reply{}
+			if json.Unmarshal(m, &rp) == nil && rp.RequestID == id {
+				return m, nil
+			}
+		case <-sub.Done():
+			span.SetError(ErrSubscriptionClosed)
+			return nil, ErrSubscriptionClosed
+		case <-deadline:
+			span.SetError(ErrTimeout)
+			return nil, ErrTimeout
+		}
+	}
+}
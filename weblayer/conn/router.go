@@ -0,0 +1,221 @@
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"workerlayer/metrics"
+	"workerlayer/presence"
+	"workerlayer/utl"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//////////////////////////////////////////////////////
+// router - one redis pub/sub connection per weblayer process
+//
+// every consumer of worker messages (websocket connection, REST request, SSE stream)
+// registers a route for its id; router SUBSCRIBEs worker.{id} and dispatches messages
+// from the single subscription to the route. when connection to redis is lost, router
+// re-dials and subscribes all current routes again.
+//
+//	websockets/REST/SSE --route(id)--> router --SUBSCRIBE worker.{id}--> redis
+//	                    <--deliver---         <--message worker.{id}---
+
+const (
+	// channel router is always subscribed on - redis does not allow subscribed state without channels
+	routerChannel = "weblayer.router"
+	// commands of admin API to every weblayer instance - see admin.go
+	adminChannel = "weblayer.admin"
+	// announcements to clients of every weblayer instance - see broadcast.go
+	broadcastChannel = "weblayer.broadcast"
+	// period of pings on router subscription
+	routerPing = 5 * time.Second
+	// router is unhealthy when there was no pong for this long
+	routerTimeout = 3 * routerPing
+	// delay before re-dial when connection to redis is lost
+	reconnectDelay = time.Second
+	// time allowed for subscribe confirmation
+	subscribeWait = 5 * time.Second
+)
+
+var ErrSubscribeTimeout = errors.New("timeout waiting for subscribe confirmation")
+
+type router struct {
+	mux sync.Mutex
+	//nil while router is (re)connecting
+	psc *redis.PubSubConn
+	//deliver functions by channel name
+	routes map[string]func([]byte)
+	//waiting for subscribe confirmation by channel name
+	waiting  map[string]chan bool
+	lastPong time.Time
+}
+
+var rt = &router{routes: make(map[string]func([]byte)), waiting: make(map[string]chan bool)}
+
+var (
+	_ = metrics.NewGaugeFunc("weblayer_router_routes", "Worker channels subscribed by router.",
+		func() float64 {
+			rt.mux.Lock()
+			defer rt.mux.Unlock()
+			return float64(len(rt.routes))
+		})
+	reconnects = metrics.NewCounter("weblayer_router_reconnects_total", "Router re-dials to redis.")
+)
+
+//start router go routine - keeps subscription running for lifetime of process
+func StartRouter() {
+	go func() {
+		for {
+			rt.serve()
+			reconnects.Inc()
+			time.Sleep(reconnectDelay)
+		}
+	}()
+}
+
+//nil when router subscription got pong recently
+func SubscriptionsHealthy() error {
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+	if rt.psc == nil {
+		return errors.New("router not connected")
+	}
+	if since := time.Since(rt.lastPong); since > routerTimeout {
+		return fmt.Errorf("no pong on router subscription for %v", since.Truncate(time.Second))
+	}
+	return nil
+}
+
+//register deliver for messages on worker.{id} and wait until subscription is confirmed
+//deliver is called from router go routine - it must not block for long
+func route(id string, deliver func([]byte)) error {
+	ch := fmt.Sprintf("worker.%s", id)
+	confirm := make(chan bool)
+
+	rt.mux.Lock()
+	rt.routes[ch] = deliver
+	rt.waiting[ch] = confirm
+	if rt.psc != nil {
+		//when not connected, serve subscribes all routes after dial
+		if err := rt.psc.Subscribe(ch); err != nil {
+			utl.WARN("router", "SUBSCRIBE", ch, err)
+		}
+	}
+	rt.mux.Unlock()
+
+	select {
+	case <-confirm:
+		return nil
+	case <-time.After(subscribeWait):
+		unroute(id)
+		return ErrSubscribeTimeout
+	}
+}
+
+//remove route and unsubscribe worker.{id}
+func unroute(id string) {
+	ch := fmt.Sprintf("worker.%s", id)
+
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+	delete(rt.routes, ch)
+	delete(rt.waiting, ch)
+	if rt.psc != nil {
+		rt.psc.Unsubscribe(ch)
+	}
+}
+
+//dial redis, subscribe all routes and dispatch messages until connection fails
+func (r *router) serve() {
+	rc := Pool.Get()
+	defer rc.Close()
+	psc := redis.PubSubConn{Conn: rc}
+
+	r.mux.Lock()
+	channels := []interface{}{routerChannel, adminChannel, broadcastChannel, presence.Channel}
+	for ch := range r.routes {
+		channels = append(channels, ch)
+	}
+	err := psc.Subscribe(channels...)
+	if err == nil {
+		r.psc = &psc
+	}
+	r.mux.Unlock()
+	if err != nil {
+		utl.ERR("router", "SUBSCRIBE", err)
+		return
+	}
+	utl.INFO("router subscribed on", len(channels), "channels")
+
+	defer func() {
+		r.mux.Lock()
+		r.psc = nil
+		r.mux.Unlock()
+	}()
+
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		pinger := time.NewTicker(routerPing)
+		defer pinger.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-pinger.C:
+				r.mux.Lock()
+				psc.Ping("")
+				r.mux.Unlock()
+			}
+		}
+	}()
+
+	for {
+		switch n := psc.Receive().(type) {
+		case error:
+			utl.ERR("router", "subscription lost", n)
+			return
+		case redis.Message:
+			if n.Channel == adminChannel {
+				//reply is published - never block router on it
+				go onAdmin(n.Data)
+				continue
+			}
+			//fan-out only queues to outboxes - it does not block, events keep their order
+			if n.Channel == broadcastChannel {
+				onBroadcast(n.Data)
+				continue
+			}
+			if n.Channel == presence.Channel {
+				onPresence(n.Data)
+				continue
+			}
+			r.mux.Lock()
+			deliver := r.routes[n.Channel]
+			r.mux.Unlock()
+			if deliver != nil {
+				deliver(n.Data)
+			}
+		case redis.Subscription:
+			if n.Kind != "subscribe" {
+				continue
+			}
+			r.mux.Lock()
+			if n.Channel == routerChannel {
+				r.lastPong = time.Now()
+			}
+			if confirm, exists := r.waiting[n.Channel]; exists {
+				close(confirm)
+				delete(r.waiting, n.Channel)
+			}
+			r.mux.Unlock()
+		case redis.Pong:
+			r.mux.Lock()
+			r.lastPong = time.Now()
+			r.mux.Unlock()
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package conn
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+	"workerlayer/messages"
+	"workerlayer/metrics"
+	"workerlayer/presence"
+	"workerlayer/utl"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+)
+
+//////////////////////////////////////////////////////
+// resumable sessions
+//
+// every websocket gets a session token in SrvSession message on connect
+// session state is stored in redis (session:{token}) with TTL, so a client reconnecting
+// to any weblayer instance with ?session={token} gets its session back.
+// pushes are full user lists, so replaying missed pushes means sending the current list
+// when its Seq is newer than last one delivered in the session
+
+const (
+	// session is kept this long after last sync
+	sessionTTL = 5 * time.Minute
+	// period of session sync to redis while connection is open
+	sessionSync = 30 * time.Second
+	// push topic of user list
+	topicUsers = "users"
+	// preferences kept in session - more are ignored
+	maxPreferences = 16
+	// longest preference name or value kept in session
+	maxPreferenceSize = 256
+)
+
+var sessionsResumed = metrics.NewCounter("weblayer_sessions_total", "Sessions on connect, by outcome.", "outcome")
+
+type session struct {
+	mux sync.Mutex
+
+	Token string
+	//authenticated user of connection that opened session, "" for anonymous - only same user resumes it
+	User string
+	//Seq of last user list written to client
+	LastSeq int64
+	//push topics of session
+	Subscriptions []string
+	//options client gave on connect (query parameters)
+	Preferences map[string]string
+}
+
+func sessionKey(token string) string {
+	return fmt.Sprintf("session:%s", token)
+}
+
+//push topics client can subscribe on connect
+var topics = map[string]bool{topicUsers: true, presence.Topic: true}
+
+//restore session of user by token or create new one, subscribe it on topics
+//returns true when session was restored
+func openSession(token, user string, prefs map[string]string, subscribe []string) (*session, bool) {
+	if token != "" {
+		s, err := loadSession(token)
+		switch {
+		case err == nil && s.User == user:
+			s.prefer(prefs)
+			s.subscribe(subscribe)
+			sessionsResumed.Inc("resumed")
+			return s, true
+		case err == nil:
+			//token of other user's session - new session, other one is left untouched
+			utl.WARN("openSession", token, "session of", s.User, "refused for", user)
+			sessionsResumed.Inc("other_user")
+		case err == redis.ErrNil:
+			sessionsResumed.Inc("expired")
+		default:
+			utl.ERR("openSession", token, err)
+			sessionsResumed.Inc("expired")
+		}
+	} else {
+		sessionsResumed.Inc("new")
+	}
+
+	s := &session{Token: uuid.New(), User: user, LastSeq: -1, Subscriptions: []string{topicUsers}, Preferences: make(map[string]string)}
+	s.prefer(prefs)
+	s.subscribe(subscribe)
+	return s, false
+}
+
+//add or update preferences - up to maxPreferences, too long ones are ignored
+func (s *session) prefer(prefs map[string]string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for k, v := range prefs {
+		if len(k) > maxPreferenceSize || len(v) > maxPreferenceSize {
+			utl.WARN("session", s.Token, "preference too long, ignored", len(k)+len(v), "bytes")
+			continue
+		}
+		if _, exists := s.Preferences[k]; !exists && len(s.Preferences) >= maxPreferences {
+			utl.WARN("session", s.Token, "too many preferences, ignored", k)
+			continue
+		}
+		s.Preferences[k] = v
+	}
+}
+
+//add known topics to subscriptions - unknown ones are ignored
+func (s *session) subscribe(list []string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, topic := range list {
+		if !topics[topic] {
+			utl.WARN("session", s.Token, "unknown topic", topic)
+			continue
+		}
+		if !contains(s.Subscriptions, topic) {
+			s.Subscriptions = append(s.Subscriptions, topic)
+		}
+	}
+}
+
+//true when session gets pushes of topic
+func (s *session) subscribed(topic string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return contains(s.Subscriptions, topic)
+}
+
+func loadSession(token string) (*session, error) {
+	rc := Pool.Get()
+	defer rc.Close()
+
+	data, err := redis.Bytes(rc.Do("GET", sessionKey(token)))
+	if err != nil {
+		return nil, err
+	}
+	s := &session{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.Preferences == nil {
+		s.Preferences = make(map[string]string)
+	}
+	return s, nil
+}
+
+//store session with fresh TTL
+func (s *session) save() {
+	s.mux.Lock()
+	data := utl.JSON(s)
+	s.mux.Unlock()
+
+	rc := Pool.Get()
+	defer rc.Close()
+	if _, err := rc.Do("SET", sessionKey(s.Token), data, "EX", int(sessionTTL.Seconds())); err != nil {
+		utl.ERR("session save", s.Token, err)
+	}
+}
+
+//true if client already got list with seq or newer one
+func (s *session) sent(seq int64) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return seq <= s.LastSeq
+}
+
+//remember seq of list written to client
+func (s *session) advance(seq int64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if seq > s.LastSeq {
+		s.LastSeq = seq
+	}
+}
+
+//SrvSession message for client
+func (s *session) message(resumed bool) []byte {
+	return utl.JSON(messages.Session{
+		Reply:   messages.Reply{Cmd: messages.SrvSession, Status: messages.StatusOK},
+		Token:   s.Token,
+		Resumed: resumed,
+	})
+}
@@ -0,0 +1,68 @@
+package conn
+
+import (
+	"errors"
+	"sync"
+	"workerlayer/utl"
+)
+
+//////////////////////////////////////////////////////
+// subscription on worker.{id} for consumers without websocket (REST, SSE)
+//
+// messages from worker are delivered on C through the router
+// C is never closed - when redis connection is lost router re-subscribes
+// router never waits for consumer: subscription whose C is full is closed (Done)
+
+//messages buffered for consumer of subscription
+const subscriptionBuffer = 64
+
+var ErrSubscriptionClosed = errors.New("subscription closed - consumer too slow")
+
+type Subscription struct {
+	C <-chan []byte
+
+	id   string
+	quit chan bool
+	once sync.Once
+}
+
+//route worker.{id} to C - returns when subscription is confirmed so publishing to worker is safe
+func Subscribe(id string) (*Subscription, error) {
+	c := make(chan []byte, subscriptionBuffer)
+	s := &Subscription{C: c, id: id, quit: make(chan bool)}
+	deliver := func(m []byte) {
+		select {
+		case c <- m:
+		case <-s.quit:
+		default:
+			//consumer does not read - router delivers to all connections of instance, never block it
+			droppedMessages.Inc("subscription_full")
+			slowConsumers.Inc()
+			utl.WARN("subscription", s.id, "consumer too slow - closing")
+			//unroute takes router lock - not from router go routine
+			go s.Close()
+		}
+	}
+	if err := route(id, deliver); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//closed when subscription is closed - by Close or because consumer was too slow
+func (s *Subscription) Done() <-chan bool {
+	return s.quit
+}
+
+//stop delivery and unsubscribe
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		close(s.quit)
+		unroute(s.id)
+	})
+}
+
+//send message to worker on conn.{id}
+func Publish(id string, m []byte) error {
+	return publish(id, m)
+}
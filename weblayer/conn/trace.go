@@ -0,0 +1,63 @@
+package conn
+
+import (
+	"encoding/json"
+	"workerlayer/messages"
+	"workerlayer/trace"
+)
+
+//////////////////////////////////////////////////////
+// tracing of messages between client and worker - see workerlayer/trace
+//
+// request from client gets span weblayer.request; its traceparent replaces TraceParent of
+// request before it is published, so worker continues the trace. parent of the span is
+// TraceParent client put in request or, when there is none, traceparent header of upgrade request.
+// reply or push with TraceParent gets span weblayer.deliver when it is queued for client.
+
+//start span of request and put its traceparent in request - m is returned unchanged when tracing is off
+func startRequest(m []byte, parent string, attrs map[string]string) ([]byte, *trace.Span) {
+	if !trace.Enabled() {
+		return m, nil
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(m, &fields); err != nil {
+		//not a request - worker replies with error, no trace to continue
+		return m, nil
+	}
+	rq := messages.ClientRQ{}
+	json.Unmarshal(m, &rq)
+	if rq.TraceParent != "" {
+		parent = rq.TraceParent
+	}
+	span := trace.Start("weblayer.request", trace.KindServer, parent)
+	span.SetAttr("cmd", rq.Cmd.String())
+	if rq.RequestID != "" {
+		span.SetAttr("request_id", rq.RequestID)
+	}
+	for k, v := range attrs {
+		span.SetAttr(k, v)
+	}
+	fields["TraceParent"], _ = json.Marshal(span.TraceParent())
+	traced, err := json.Marshal(fields)
+	if err != nil {
+		span.SetError(err)
+		span.End()
+		return m, nil
+	}
+	return traced, span
+}
+
+//start span of message from worker - nil when message is not part of a trace
+func startDelivery(m []byte, connID string) *trace.Span {
+	if !trace.Enabled() {
+		return nil
+	}
+	rp := messages.Reply{}
+	if json.Unmarshal(m, &rp) != nil || rp.TraceParent == "" {
+		return nil
+	}
+	span := trace.Start("weblayer.deliver", trace.KindConsumer, rp.TraceParent)
+	span.SetAttr("conn_id", connID)
+	span.SetAttr("cmd", rp.Cmd.String())
+	return span
+}
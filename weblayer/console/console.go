@@ -0,0 +1,34 @@
+// console package serves static HTML test console
+//
+// page connects to /ws of the same host and has forms for every request type,
+// live view of user list pushes, connection status and log of raw frames
+package console
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed index.html
+var page []byte
+
+//register console on / and /console
+func Register(mux *http.ServeMux) {
+	mux.HandleFunc("/", serveConsole)
+	mux.HandleFunc("/console", serveConsole)
+}
+
+func serveConsole(w http.ResponseWriter, r *http.Request) {
+	//"/" pattern matches everything not registered elsewhere
+	if r.URL.Path != "/" && r.URL.Path != "/console" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
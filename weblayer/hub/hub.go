@@ -1,18 +1,45 @@
 package hub
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"weblayer/admin"
+	"weblayer/auth"
 	"weblayer/conn"
+	"weblayer/console"
+	"weblayer/proxy"
+	"weblayer/rest"
+	"weblayer/sse"
 	"weblayer/usage"
+	"workerlayer/health"
+	"workerlayer/metrics"
+	"workerlayer/trace"
 	"workerlayer/utl"
 
 	"github.com/gorilla/websocket"
 )
 
-// serverWs handles websocket requests
-func serveWs(w http.ResponseWriter, r *http.Request) {
+var (
+	//HMAC key of user tokens, "" when auth is off
+	authSecret string
+	//proxies whose forwarding headers are believed
+	proxies proxy.Trusted
+)
+
+// serveWs returns handler of websocket requests for endpoint path with opts
+func serveWs(path string, opts conn.Options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		upgrade(w, r, conn.Params{Options: opts, Path: path})
+	}
+}
+
+func upgrade(w http.ResponseWriter, r *http.Request, p conn.Params) {
 
 	if r.Method != "GET" {
 		http.Error(w, "Method not allowed", 405)
@@ -20,8 +47,25 @@ func serveWs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//case behind proxy
-	clientIP := r.Header.Get("X-Forwarded-For")
+	//shutdown in progress - do not upgrade new websockets
+	if conn.ShuttingDown() {
+		http.Error(w, "Service unavailable", 503)
+		return
+	}
+
+	//case behind proxy - headers count only from trusted proxies
+	p.ClientAddr = proxies.ClientAddr(r)
+
+	//token is optional - client without one is anonymous, client with bad one is refused
+	if token := auth.FromRequest(r); token != "" && authSecret != "" {
+		user, err := auth.Verify(authSecret, token)
+		if err != nil {
+			utl.WARN(p.ClientAddr, "serveWs", err)
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+		p.User = user
+	}
 
 	var upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
@@ -35,20 +79,118 @@ func serveWs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	utl.INFO(clientIP, "serveWs", "new connection!", ws.UnderlyingConn().RemoteAddr())
-	conn.StartConnection(ws)
+	utl.INFO(p.ClientAddr, "serveWs", "new connection!", ws.UnderlyingConn().RemoteAddr())
+	p.Token, p.Prefs = sessionParams(r)
+	//?tag=a&tag=b - announcements can target connections by tag
+	p.Tags = r.URL.Query()["tag"]
+	//?subscribe=presence - join/leave events of users
+	p.Subscribe = r.URL.Query()["subscribe"]
+	//set by tracing proxy or client library - parent of requests of this connection
+	p.TraceParent = r.Header.Get("traceparent")
+	conn.StartConnection(ws, p)
+
+}
+
+//session token (?session= or X-Session-Token header) and rest of query parameters except access token, tags and subscriptions as preferences
+func sessionParams(r *http.Request) (string, map[string]string) {
+	query := r.URL.Query()
+	token := query.Get("session")
+	if token == "" {
+		token = r.Header.Get("X-Session-Token")
+	}
+	prefs := make(map[string]string)
+	for k, v := range query {
+		if k != "session" && k != "tag" && k != "subscribe" && k != auth.QueryParam && len(v) > 0 {
+			prefs[k] = v[0]
+		}
+	}
+	return token, prefs
+}
+
+// time allowed for connections to close on shutdown
+const shutdownWait = 10 * time.Second
+
+// waits for SIGINT/SIGTERM
+// stops accepting new connections, closes all websockets and waits for controllers to finish
+func handleSignals(srv *http.Server, done chan bool) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sig
+	utl.INFO("hub", "got signal", s, "- shutting down")
+	//refuse new websockets and end SSE streams - http.Server.Shutdown waits for them
+	conn.BeginShutdown()
 
+	//stop listener - hijacked websockets are not touched by http.Server
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownWait)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		utl.ERR("hub", "http shutdown", err)
+	}
+	//send close frame to every websocket and wait for controllers
+	conn.CloseAll(shutdownWait)
+	//spans of last requests
+	trace.Flush(time.Second)
+	close(done)
 }
 
 func Start() {
 
-	conn.InitRedisPool()
-	port := usage.Port()
-	http.HandleFunc("/ws", serveWs)
-	err := http.ListenAndServe(fmt.Sprintf("0.0.0.0:%v", port), nil)
+	cfg, err := usage.Load()
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		log.Fatal("config: ", err)
 	}
+	utl.ConfigureLog(cfg.Log)
+	for _, line := range cfg.Print() {
+		utl.INFO("config", line)
+	}
+	if err := trace.Init(cfg.Tracing, "weblayer"); err != nil {
+		log.Fatal("tracing: ", err)
+	}
+	port := cfg.Port
+	mux := Setup(cfg)
+	srv := &http.Server{Addr: fmt.Sprintf("0.0.0.0:%v", port), Handler: mux}
+
+	done := make(chan bool)
+	go handleSignals(srv, done)
+
 	utl.INFO("Listening plain text http/ws on port", port)
+	err = srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal("ListenAndServe: ", err)
+	}
+	//wait for connections to close
+	<-done
+	utl.INFO("hub stopped")
+}
+
+//connect to redis, start router and presence sweeper and register all endpoints
+//cfg must be validated - Start serves returned mux, tests serve it with httptest
+func Setup(cfg *usage.Config) *http.ServeMux {
+	eps, _ := cfg.Endpoints()
+	proxies, _ = cfg.Proxies()
+	authSecret = cfg.Auth.Secret
 
+	conn.InitRedisPool(cfg.Redis)
+	conn.StartRouter()
+	conn.StartPresence()
+
+	checker := health.New()
+	checker.Add("redis", health.RedisPing(conn.Pool))
+	checker.Add("subscriptions", conn.SubscriptionsHealthy)
+	checker.Add("shutdown", health.NotShuttingDown(conn.ShuttingDown))
+
+	mux := http.NewServeMux()
+	for path, opts := range eps {
+		utl.INFO("websocket endpoint", path, opts)
+		mux.HandleFunc(path, serveWs(path, opts))
+	}
+	if cfg.Admin.Token != "" {
+		admin.Register(mux, cfg.Admin.Token, cfg.Auth.Secret)
+	}
+	rest.Register(mux)
+	sse.Register(mux)
+	console.Register(mux)
+	checker.Register(mux)
+	mux.Handle("/metrics", metrics.Handler())
+	return mux
 }
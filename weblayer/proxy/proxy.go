@@ -0,0 +1,117 @@
+// proxy package resolves address of client behind trusted reverse proxies
+//
+// headers with client address (Forwarded, X-Forwarded-For) are believed only when request
+// comes from a trusted proxy. hops are read from right (nearest proxy) to left and the first
+// address that is not a trusted proxy is the client - anything left of it could be forged by client.
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+//networks of trusted proxies
+type Trusted []*net.IPNet
+
+//parse CIDRs - single address is trusted as /32 or /128
+func Parse(list []string) (Trusted, error) {
+	var t Trusted
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q: invalid address", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			t = append(t, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %v", s, err)
+		}
+		t = append(t, n)
+	}
+	return t, nil
+}
+
+//true when ip is in one of trusted networks
+func (t Trusted) Contains(ip net.IP) bool {
+	for _, n := range t {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//IP of client without port: peer of direct request,
+//client from forwarding headers for request from trusted proxy
+func (t Trusted) ClientAddr(r *http.Request) string {
+	ip := parseIP(r.RemoteAddr)
+	if ip == nil {
+		return r.RemoteAddr
+	}
+	if !t.Contains(ip) {
+		return ip.String()
+	}
+	hops := forwardedFor(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseIP(hops[i])
+		if hop == nil {
+			//obfuscated or unknown hop - nearest valid address is the best we know
+			break
+		}
+		ip = hop
+		if !t.Contains(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+//IP of address with or without port
+func IP(addr string) string {
+	if ip := parseIP(addr); ip != nil {
+		return ip.String()
+	}
+	return addr
+}
+
+//client and proxies from left to right - Forwarded (RFC 7239) wins over X-Forwarded-For
+func forwardedFor(r *http.Request) []string {
+	var hops []string
+	for _, h := range r.Header["Forwarded"] {
+		for _, element := range strings.Split(h, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hops = append(hops, strings.Trim(kv[1], `"`))
+				}
+			}
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+	for _, h := range r.Header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(h, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+//"1.2.3.4", "1.2.3.4:80", "::1", "[::1]:80" - nil when it is not an address
+func parseIP(s string) net.IP {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientAddr(t *testing.T) {
+	trusted, err := Parse([]string{"10.0.0.0/8", "192.168.1.5", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name   string
+		peer   string
+		header http.Header
+		want   string
+	}{
+		{"direct request", "1.2.3.4:5000", nil, "1.2.3.4"},
+		{"direct ipv6 request", "[2001:db8::1]:5000", nil, "2001:db8::1"},
+		{"untrusted peer with headers", "1.2.3.4:5000",
+			http.Header{"X-Forwarded-For": {"9.9.9.9"}, "Forwarded": {"for=8.8.8.8"}}, "1.2.3.4"},
+		{"trusted peer without headers", "10.0.0.1:5000", nil, "10.0.0.1"},
+		{"x-forwarded-for", "10.0.0.1:5000", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "1.2.3.4"},
+		{"spoofed left-most hop", "10.0.0.1:5000", http.Header{"X-Forwarded-For": {"6.6.6.6, 1.2.3.4"}}, "1.2.3.4"},
+		{"spoofed hop in separate header", "10.0.0.1:5000",
+			http.Header{"X-Forwarded-For": {"6.6.6.6", "1.2.3.4, 10.0.0.2"}}, "1.2.3.4"},
+		{"chain of trusted hops", "10.0.0.1:5000",
+			http.Header{"X-Forwarded-For": {"6.6.6.6, 1.2.3.4, 192.168.1.5, 10.0.0.2"}}, "1.2.3.4"},
+		{"all hops trusted", "10.0.0.1:5000", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"forwarded wins over x-forwarded-for", "10.0.0.1:5000",
+			http.Header{"Forwarded": {"for=1.2.3.4;proto=https"}, "X-Forwarded-For": {"6.6.6.6"}}, "1.2.3.4"},
+		{"forwarded chain", "10.0.0.1:5000",
+			http.Header{"Forwarded": {"for=6.6.6.6, for=1.2.3.4;by=10.0.0.2, for=10.0.0.2"}}, "1.2.3.4"},
+		{"forwarded ipv6 with brackets and port", "10.0.0.1:5000",
+			http.Header{"Forwarded": {`for="[2001:db8::1]:4711"`}}, "2001:db8::1"},
+		{"x-forwarded-for ipv6 with brackets and port", "[fd00::1]:5000",
+			http.Header{"X-Forwarded-For": {"[2001:db8::1]:4711"}}, "2001:db8::1"},
+		{"forwarded for=unknown", "10.0.0.1:5000",
+			http.Header{"Forwarded": {"for=1.2.3.4, for=unknown, for=10.0.0.2"}}, "10.0.0.2"},
+		{"forwarded obfuscated", "10.0.0.1:5000", http.Header{"Forwarded": {`for="_hidden"`}}, "10.0.0.1"},
+		{"garbage hop", "10.0.0.1:5000", http.Header{"X-Forwarded-For": {"1.2.3.4, not-an-ip"}}, "10.0.0.1"},
+	} {
+		r := &http.Request{RemoteAddr: c.peer, Header: c.header}
+		if got := trusted.ClientAddr(r); got != c.want {
+			t.Errorf("%s: expected %s, got %s", c.name, c.want, got)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	trusted, err := Parse([]string{" 10.0.0.0/8", "192.168.1.5", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{"10.1.2.3": true, "192.168.1.5": true, "192.168.1.6": false, "::1": true, "11.0.0.1": false} {
+		if got := trusted.Contains(parseIP(addr)); got != want {
+			t.Errorf("%s: expected trusted %v, got %v", addr, want, got)
+		}
+	}
+	for _, bad := range []string{"10.0.0.0/33", "not-an-ip"} {
+		if _, err := Parse([]string{bad}); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// rest package serves HTTP API for services that don't want to keep websocket open
+//
+//	GET    /users         - sorted list of all users
+//	GET    /users/{name}  - one user
+//	PUT    /users/{name}  - set favorite number, body {"FavoriteNumber":11}
+//	DELETE /users/{name}  - delete user
+//
+// requests go to worker over redis like websocket messages and block for worker reply
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"weblayer/conn"
+	"workerlayer/messages"
+	"workerlayer/metrics"
+	"workerlayer/utl"
+
+	"github.com/pborman/uuid"
+)
+
+// time allowed for worker to reply
+const requestTimeout = 5 * time.Second
+
+var requests = metrics.NewCounter("weblayer_rest_requests_total", "REST requests, by method and status code.", "method", "code")
+
+//register routes on mux
+func Register(mux *http.ServeMux) {
+	mux.HandleFunc("/users", serveUsers)
+	mux.HandleFunc("/users/", serveUser)
+}
+
+// GET /users
+func serveUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	rq := messages.ClientGetList{ClientRQ: newRQ(r, messages.RQListAllUsers)}
+	rp := messages.AllUserlist{}
+	if !roundtrip(w, r, rq, &rp, &rp.Reply) {
+		return
+	}
+	if rp.AllUsers == nil {
+		rp.AllUsers = []messages.User{}
+	}
+	writeJSON(w, r, http.StatusOK, rp.AllUsers)
+}
+
+// GET, PUT, DELETE /users/{name}
+func serveUser(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/users/")
+	if name == "" || strings.Contains(name, "/") {
+		writeError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		rq := messages.ClientGetUser{ClientRQ: newRQ(r, messages.RQGetUser), CmdData: messages.GetUser{UserName: name}}
+		rp := messages.UserReply{}
+		if roundtrip(w, r, rq, &rp, &rp.Reply) {
+			writeJSON(w, r, http.StatusOK, rp.User)
+		}
+	case "PUT":
+		body := struct{ FavoriteNumber *int }{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.FavoriteNumber == nil {
+			writeError(w, r, http.StatusBadRequest, `Expected body {"FavoriteNumber":<int>}`)
+			return
+		}
+		data := messages.SetFavoriteNumber{UserName: name, FavoriteNumber: *body.FavoriteNumber}
+		rq := messages.ClientSetFavoriteNumber{ClientRQ: newRQ(r, messages.RQSetFavoriteNumber), CmdData: data}
+		rp := messages.Reply{}
+		if roundtrip(w, r, rq, &rp, &rp) {
+			writeJSON(w, r, http.StatusOK, messages.User{Username: data.UserName, Favnum: data.FavoriteNumber})
+		}
+	case "DELETE":
+		rq := messages.ClientDeleteUser{ClientRQ: newRQ(r, messages.RQDeleteUser), CmdData: messages.DeleteUser{UserName: name}}
+		rp := messages.Reply{}
+		if roundtrip(w, r, rq, &rp, &rp) {
+			w.WriteHeader(http.StatusNoContent)
+			requests.Inc(r.Method, strconv.Itoa(http.StatusNoContent))
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+///////////////////
+//HELPER FUNCTIONS
+
+//request header with fresh RequestID - traceparent header of r is parent of its trace
+func newRQ(r *http.Request, cmd messages.RQEnum) messages.ClientRQ {
+	return messages.ClientRQ{Cmd: cmd, RequestID: uuid.New(), TraceParent: r.Header.Get("traceparent")}
+}
+
+//send request to worker, unmarshal reply into rp and check its status
+//on failure writes error response and returns false
+func roundtrip(w http.ResponseWriter, r *http.Request, rq messages.ClientRequest, rp interface{}, status *messages.Reply) bool {
+	if conn.ShuttingDown() {
+		writeError(w, r, http.StatusServiceUnavailable, "Service unavailable")
+		return false
+	}
+
+	l := utl.With(utl.Fields{RequestID: rq.ID(), Cmd: rq.Request().String(), RemoteAddr: r.RemoteAddr})
+	start := time.Now()
+	data, err := conn.Request(rq, requestTimeout)
+	l = l.With(utl.Fields{Duration: time.Since(start)})
+	if err == conn.ErrTimeout {
+		l.WARN("rest", err)
+		writeError(w, r, http.StatusGatewayTimeout, err.Error())
+		return false
+	}
+	if err != nil {
+		l.ERR("rest", err)
+		writeError(w, r, http.StatusBadGateway, err.Error())
+		return false
+	}
+	l.INFO("rest", r.Method, r.URL.Path)
+	if err := json.Unmarshal(data, rp); err != nil {
+		l.ERR("rest", "invalid reply", string(data), err)
+		writeError(w, r, http.StatusBadGateway, "invalid worker reply")
+		return false
+	}
+	if status.Status != messages.StatusOK {
+		code := http.StatusBadRequest
+		if status.Error == messages.ErrUserNotFound {
+			code = http.StatusNotFound
+		}
+		writeError(w, r, code, status.Error)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(utl.JSON(v))
+	requests.Inc(r.Method, strconv.Itoa(code))
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	http.Error(w, msg, code)
+	requests.Inc(r.Method, strconv.Itoa(code))
+}
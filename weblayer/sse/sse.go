@@ -0,0 +1,149 @@
+// sse package streams user list pushes as Server-Sent Events
+//
+//	GET /events
+//
+// every stream has same lifecycle toward worker as websocket connection (init/closed on conn.{id})
+// and gets the same AllUserlist pushes. event id is Seq of the list, so a client reconnecting
+// with Last-Event-ID gets the current list only if it changed in the meantime. Last-Event-ID
+// newer than current list means seq was reset (redis flushed) - the list is sent then
+package sse
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"weblayer/conn"
+	"workerlayer/messages"
+	"workerlayer/metrics"
+	"workerlayer/utl"
+
+	"github.com/pborman/uuid"
+)
+
+const (
+	// comment line is sent with this period so proxies don't close idle stream
+	keepAlive = 30 * time.Second
+	// reconnection delay suggested to client in milliseconds
+	retryMillis = 3000
+	// time allowed for one write to client - stalled client ends its stream
+	writeWait = 10 * time.Second
+)
+
+var streams = metrics.NewGauge("weblayer_sse_streams_active", "Server-Sent Events streams currently open.")
+
+//register /events on mux
+func Register(mux *http.ServeMux) {
+	mux.HandleFunc("/events", serveEvents)
+}
+
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "Streaming not supported", 500)
+		return
+	}
+	if conn.ShuttingDown() {
+		http.Error(w, "Service unavailable", 503)
+		return
+	}
+
+	last := lastEventID(r)
+	id := uuid.New()
+
+	sub, err := conn.Subscribe(id)
+	if err != nil {
+		utl.ERR("sse", "subscribe", err)
+		http.Error(w, "Bad gateway", 502)
+		return
+	}
+	defer sub.Close()
+
+	//same lifecycle toward worker as websocket connection
+	conn.Publish(id, []byte("init"))
+	defer conn.Publish(id, []byte("closed"))
+	//current list - skipped below if client already has it
+	conn.Publish(id, utl.JSON(messages.ClientGetList{ClientRQ: messages.ClientRQ{Cmd: messages.RQListAllUsers, RequestID: id}}))
+
+	streams.Inc()
+	defer streams.Dec()
+	utl.INFO(r.RemoteAddr, "sse", "new stream", id, "last event id", last)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	write := func(format string, a ...interface{}) error {
+		rc.SetWriteDeadline(time.Now().Add(writeWait))
+		if _, err := fmt.Fprintf(w, format, a...); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	if err := write("retry: %d\n\n", retryMillis); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	//no list written on this stream yet
+	first := true
+	for {
+		select {
+		case m := <-sub.C:
+			rp := messages.AllUserlist{}
+			if err := json.Unmarshal(m, &rp); err != nil || rp.Cmd != messages.SrvListAllUsers {
+				continue
+			}
+			//Last-Event-ID ahead of current list - seq was reset (redis flushed, new cluster), client's list is stale
+			if first && rp.RequestID == id && rp.Seq < last {
+				last = -1
+			}
+			//client already has this version (or newer)
+			if rp.Seq <= last {
+				continue
+			}
+			last = rp.Seq
+			first = false
+			//RequestID belongs to this stream, not to the client
+			rp.RequestID = ""
+			if err := write("id: %d\nevent: userlist\ndata: %s\n\n", rp.Seq, utl.JSON(rp)); err != nil {
+				utl.WARN(r.RemoteAddr, "sse", "write failed", id, err)
+				return
+			}
+		case <-ticker.C:
+			if err := write(": keep-alive\n\n"); err != nil {
+				utl.WARN(r.RemoteAddr, "sse", "write failed", id, err)
+				return
+			}
+		case <-sub.Done():
+			utl.WARN(r.RemoteAddr, "sse", "stream too slow - closed", id)
+			return
+		case <-r.Context().Done():
+			utl.INFO(r.RemoteAddr, "sse", "stream closed by client", id)
+			return
+		case <-conn.Stopping():
+			return
+		}
+	}
+}
+
+//Last-Event-ID header, or lastEventId query parameter for clients that can't set headers
+//-1 when not present
+func lastEventID(r *http.Request) int64 {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("lastEventId")
+	}
+	last, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return last
+}
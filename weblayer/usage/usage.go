@@ -1,38 +1,194 @@
 package usage
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+	"weblayer/conn"
+	"weblayer/proxy"
+	"workerlayer/config"
+	"workerlayer/redisconn"
+	"workerlayer/trace"
+	"workerlayer/utl"
+
 	"github.com/docopt/docopt-go"
 )
 
 var usage = `weblayer
 
 Usage:
-  weblayer_api [--port=port] [--redis=ip] 
+  weblayer_api [--config=file] [--port=port] [--redis-url=url] [--redis=ip] [--redis-port=n] [--redis-db=n] [--redis-sentinel-master=name] [--redis-sentinel=addr]... [--redis-cluster=addr]... [--write-wait=d] [--pong-wait=d] [--ping-period=d] [--conn-delay=d] [--max-message-size=n] [--endpoint=spec]... [--trusted-proxy=cidr]... [--log-format=f] [--log-level=l] [--trace-exporter=e] [--trace-endpoint=url] [--trace-file=file]
   weblayer_api -h | --help
   weblayer_api --version
 
 Options:
-  -h --help             Show this screen.
-  --version             Show version.
-  --port=port           Listening port of service
-  --redis=ip            Redis server 
+  -h --help               Show this screen.
+  --version               Show version.
+  --config=file           YAML config file [env WEBLAYER_CONFIG]
+  --port=port             Listening port of service [env WEBLAYER_PORT, default 8888]
+  --redis-url=url         Redis URL redis://[user:password@]host:port/db or rediss:// for TLS [env WEBLAYER_REDIS_URL]
+  --redis=ip              Redis server [env WEBLAYER_REDIS, default 127.0.0.1]
+  --redis-port=n          Redis port [env WEBLAYER_REDIS_PORT, default 6379]
+  --redis-db=n            Redis database, overrides db of --redis-url [env WEBLAYER_REDIS_DB, default db of URL, else 0]
+  --redis-sentinel-master=name  Discover primary of this master through sentinels [env WEBLAYER_REDIS_SENTINEL_MASTER]
+  --redis-sentinel=addr   Sentinel host:port, repeat for every sentinel [env WEBLAYER_REDIS_SENTINEL_ADDRS, separated by ;]
+  --redis-cluster=addr    Redis Cluster node host:port, repeat for more seed nodes [env WEBLAYER_REDIS_CLUSTER_ADDRS, separated by ;]
+  --write-wait=d          Time allowed to write a message to client [env WEBLAYER_WRITE_WAIT, default 50s]
+  --pong-wait=d           Time allowed to read next pong from client [env WEBLAYER_PONG_WAIT, default 600s]
+  --ping-period=d         Ping period, less than pong wait [env WEBLAYER_PING_PERIOD, default 0 - 7/10 of pong wait]
+  --conn-delay=d          Delay of connection exit after close [env WEBLAYER_CONN_DELAY, default 2s]
+  --max-message-size=n    Max size of client message in bytes [env WEBLAYER_MAX_MESSAGE_SIZE, default 15360]
+  --endpoint=spec         Extra websocket path with overrides, e.g. /ws/mobile:ping-period=25s,pong-wait=60s
+                          [env WEBLAYER_ENDPOINTS, separated by ;]
+  --trusted-proxy=cidr    Proxy network whose Forwarded/X-Forwarded-For is believed, e.g. 10.0.0.0/8
+                          [env WEBLAYER_TRUSTED_PROXIES, separated by ;]
+  --log-format=f          Log output text or json [env WEBLAYER_LOG_FORMAT, default text]
+  --log-level=l           debug, notice, info, warn or error [env WEBLAYER_LOG_LEVEL, default info]
+  --trace-exporter=e      Export spans: none, otlp or file [env WEBLAYER_TRACE_EXPORTER, default none]
+  --trace-endpoint=url    OTLP/HTTP traces URL [env WEBLAYER_TRACE_ENDPOINT, default http://localhost:4318/v1/traces]
+  --trace-file=file       JSON lines file of file exporter [env WEBLAYER_TRACE_FILE]
+
+Redis username/password, TLS certificates and pool are set only in config file or env
+(WEBLAYER_REDIS_USERNAME, WEBLAYER_REDIS_PASSWORD, WEBLAYER_REDIS_TLS_*, WEBLAYER_REDIS_POOL_*,
+WEBLAYER_REDIS_SENTINEL_PASSWORD), as are secrets of user tokens and admin API
+(WEBLAYER_AUTH_SECRET, WEBLAYER_ADMIN_TOKEN).
+Precedence: defaults < config file < env < flags.
   `
 
-func Port() string {
-	arguments, _ := docopt.Parse(usage, nil, true, "weblayer 2.0", false)
-	path := arguments["--port"]
-	if path == nil {
-		return "8888"
+//environment variables are WEBLAYER_{env tag}
+const envPrefix = "WEBLAYER"
+
+//configuration of weblayer
+type Config struct {
+	Port      string            `yaml:"port" env:"PORT" flag:"--port"`
+	Redis     redisconn.Options `yaml:"redis"`
+	Websocket Websocket         `yaml:"websocket"`
+	Auth      Auth              `yaml:"auth"`
+	Admin     Admin             `yaml:"admin"`
+	//CIDRs or addresses of reverse proxies in front of weblayer
+	TrustedProxies []string       `yaml:"trusted_proxies" env:"TRUSTED_PROXIES" flag:"--trusted-proxy"`
+	Log            utl.LogOptions `yaml:"log"`
+	Tracing        trace.Options  `yaml:"tracing"`
+}
+
+//options of /ws endpoint and extra endpoints with overrides
+type Websocket struct {
+	WriteWait      time.Duration `yaml:"write_wait" env:"WRITE_WAIT" flag:"--write-wait"`
+	PongWait       time.Duration `yaml:"pong_wait" env:"PONG_WAIT" flag:"--pong-wait"`
+	PingPeriod     time.Duration `yaml:"ping_period" env:"PING_PERIOD" flag:"--ping-period"`
+	ConnDelay      time.Duration `yaml:"conn_delay" env:"CONN_DELAY" flag:"--conn-delay"`
+	MaxMessageSize int64         `yaml:"max_message_size" env:"MAX_MESSAGE_SIZE" flag:"--max-message-size"`
+	//"path:key=value,key=value"
+	Endpoints []string `yaml:"endpoints" env:"ENDPOINTS" flag:"--endpoint"`
+}
+
+//user tokens of websocket clients
+type Auth struct {
+	//HMAC key of tokens - all clients are anonymous when empty
+	Secret string `yaml:"secret" env:"AUTH_SECRET" secret:"true"`
+}
+
+//admin API
+type Admin struct {
+	//bearer token of admin requests - API is off when empty
+	Token string `yaml:"token" env:"ADMIN_TOKEN" secret:"true"`
+}
+
+// admin token shorter than this is rejected
+const minAdminToken = 16
+
+//configuration with defaults
+func Default() *Config {
+	opts := conn.DefaultOptions()
+	return &Config{
+		Port:    "8888",
+		Redis:   redisconn.DefaultOptions(),
+		Log:     utl.DefaultLogOptions(),
+		Tracing: trace.DefaultOptions(),
+		Websocket: Websocket{
+			WriteWait:      opts.WriteWait,
+			PongWait:       opts.PongWait,
+			PingPeriod:     opts.PingPeriod,
+			ConnDelay:      opts.ConnDelay,
+			MaxMessageSize: opts.MaxMessageSize,
+		},
 	}
-	return path.(string)
 }
 
-func Redis() string {
+//parse command line once and load configuration from all sources
+func Load() (*Config, error) {
 	arguments, _ := docopt.Parse(usage, nil, true, "weblayer 2.0", false)
-	path := arguments["--redis"]
-	if path == nil {
-		return "127.0.0.1"
+	file, _ := arguments["--config"].(string)
+	if file == "" {
+		file = os.Getenv(envPrefix + "_CONFIG")
+	}
+
+	cfg := Default()
+	if err := config.Load(cfg, file, envPrefix, arguments); err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.Port == "" {
+		return errors.New("port is required")
+	}
+	if err := cfg.Redis.Validate(); err != nil {
+		return fmt.Errorf("redis: %v", err)
+	}
+	if err := cfg.Log.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.Tracing.Validate(); err != nil {
+		return err
+	}
+	if cfg.Admin.Token != "" && len(cfg.Admin.Token) < minAdminToken {
+		return fmt.Errorf("admin token must have at least %d characters", minAdminToken)
 	}
+	if _, err := cfg.Proxies(); err != nil {
+		return err
+	}
+	_, err := cfg.Endpoints()
+	return err
+}
+
+//trusted proxy networks
+func (cfg *Config) Proxies() (proxy.Trusted, error) {
+	return proxy.Parse(cfg.TrustedProxies)
+}
+
+//options of /ws endpoint
+func (w Websocket) Options() conn.Options {
+	return conn.Options{
+		WriteWait:      w.WriteWait,
+		PongWait:       w.PongWait,
+		PingPeriod:     w.PingPeriod,
+		ConnDelay:      w.ConnDelay,
+		MaxMessageSize: w.MaxMessageSize,
+	}
+}
+
+//websocket endpoints - /ws with deployment options and extra paths with their overrides
+func (cfg *Config) Endpoints() (map[string]conn.Options, error) {
+	base := cfg.Websocket.Options()
+	if err := base.Validate(); err != nil {
+		return nil, fmt.Errorf("websocket: %v", err)
+	}
+
+	eps := map[string]conn.Options{"/ws": base}
+	for _, spec := range cfg.Websocket.Endpoints {
+		path, opts, err := conn.ParseEndpoint(spec, base)
+		if err != nil {
+			return nil, err
+		}
+		eps[path] = opts
+	}
+	return eps, nil
+}
 
-	return path.(string)
+//effective configuration for log, secrets redacted
+func (cfg *Config) Print() []string {
+	return config.Print(cfg)
 }
@@ -0,0 +1,157 @@
+// config package loads typed configuration of a binary from file, environment and flags
+//
+// configuration is a struct with defaults already set, fields are described with tags
+//
+//	Port     string `yaml:"port" env:"PORT" flag:"--port"`
+//	Password string `yaml:"password" env:"REDIS_PASSWORD" secret:"true"`
+//
+// precedence (later wins): defaults, YAML file, environment ({prefix}_{env}), flags
+// nested structs are sections of YAML file, their fields have own env/flag tags
+// supported field types: string, bool, int, int64, time.Duration, []string (env separated by ;)
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+//value printed instead of secret fields
+const redacted = "*****"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+//fill cfg (pointer to struct) from file (skipped when empty), environment and docopt arguments
+func Load(cfg interface{}, file, envPrefix string, args map[string]interface{}) error {
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return walk(reflect.ValueOf(cfg).Elem(), "", func(f reflect.StructField, v reflect.Value, _ string) error {
+		if env := f.Tag.Get("env"); env != "" {
+			if s, ok := os.LookupEnv(envPrefix + "_" + env); ok {
+				if err := set(v, s); err != nil {
+					return fmt.Errorf("%s_%s: %v", envPrefix, env, err)
+				}
+			}
+		}
+		if flag := f.Tag.Get("flag"); flag != "" {
+			if err := setArg(v, args[flag]); err != nil {
+				return fmt.Errorf("%s: %v", flag, err)
+			}
+		}
+		return nil
+	})
+}
+
+//effective configuration as "key: value" lines in YAML key notation, secrets redacted
+func Print(cfg interface{}) []string {
+	var lines []string
+	walk(reflect.ValueOf(cfg).Elem(), "", func(f reflect.StructField, v reflect.Value, key string) error {
+		value := fmt.Sprint(v.Interface())
+		if f.Tag.Get("secret") == "true" && value != "" {
+			value = redacted
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", key, value))
+		return nil
+	})
+	return lines
+}
+
+//call fn for every leaf field of struct v, key is dotted path of yaml names
+func walk(v reflect.Value, prefix string, fn func(reflect.StructField, reflect.Value, string) error) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			//unexported
+			continue
+		}
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		key := prefix + name
+		if f.Type.Kind() == reflect.Struct && f.Type != durationType {
+			if err := walk(v.Field(i), key+".", fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn(f, v.Field(i), key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//set docopt argument - nil/false when flag was not given
+func setArg(v reflect.Value, arg interface{}) error {
+	switch a := arg.(type) {
+	case string:
+		return set(v, a)
+	case []string:
+		if len(a) > 0 {
+			v.Set(reflect.ValueOf(a))
+		}
+	case bool:
+		if a {
+			v.SetBool(true)
+		}
+	}
+	return nil
+}
+
+//set field from string
+func set(v reflect.Value, s string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(s, ";") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %v", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+//end-to-end tests - weblayer hub, worker loop and websocket clients against in-process fakeredis
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"weblayer/hub"
+	weblayerusage "weblayer/usage"
+	"workerlayer/fakeredis"
+	"workerlayer/messages"
+	"workerlayer/redisconn"
+	"workerlayer/usage"
+	"workerlayer/utl"
+	"wsclient"
+)
+
+//time allowed for reply or push in tests
+const waitFor = 5 * time.Second
+
+var web *httptest.Server
+
+func TestMain(m *testing.M) {
+	utl.ConfigureLog(utl.LogOptions{Format: utl.FormatText, Level: "error"})
+	fake, err := fakeredis.Start()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fakeredis:", err)
+		os.Exit(1)
+	}
+
+	opts := redisconn.DefaultOptions()
+	opts.URL = fake.URL()
+
+	//worker
+	initRedis(opts)
+	initStore(usage.StoreRedis, false)
+	go readConnMessages()
+
+	//weblayer
+	cfg := weblayerusage.Default()
+	cfg.Redis = opts
+	cfg.Websocket.ConnDelay = 100 * time.Millisecond
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "weblayer config:", err)
+		os.Exit(1)
+	}
+	web = httptest.NewServer(hub.Setup(cfg))
+
+	//connections opened before worker is subscribed would miss their init message
+	deadline := time.Now().Add(waitFor)
+	for subscriptionHealthy() != nil {
+		if time.Now().After(deadline) {
+			fmt.Fprintln(os.Stderr, "worker did not subscribe on conn.*")
+			os.Exit(1)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	code := m.Run()
+	web.Close()
+	fake.Close()
+	os.Exit(code)
+}
+
+func dial(t *testing.T) *wsclient.Client {
+	t.Helper()
+	opts := wsclient.DefaultOptions("ws" + strings.TrimPrefix(web.URL, "http") + "/ws")
+	opts.RequestTimeout = waitFor
+	c, err := wsclient.Dial(opts)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	//worker subscribes on changes after it gets init message of connection - set until own change is pushed
+	deadline := time.Now().Add(waitFor)
+	for n := 1; ; n++ {
+		if err := c.SetFavoriteNumber("e2e-ready", n); err != nil {
+			t.Fatal("set:", err)
+		}
+		select {
+		case list := <-c.Lists:
+			if favorites(list.AllUsers)["e2e-ready"] == n {
+				discardLists(c)
+				return c
+			}
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no push to new connection")
+		}
+	}
+}
+
+//discard pushes already queued for c
+func discardLists(c *wsclient.Client) {
+	for {
+		select {
+		case <-c.Lists:
+		default:
+			return
+		}
+	}
+}
+
+//wait for pushed list that satisfies ok
+func waitList(t *testing.T, c *wsclient.Client, ok func(map[string]int) bool) {
+	t.Helper()
+	timeout := time.After(waitFor)
+	for {
+		select {
+		case list := <-c.Lists:
+			if ok(favorites(list.AllUsers)) {
+				return
+			}
+		case <-timeout:
+			t.Fatal("no matching push")
+		}
+	}
+}
+
+func favorites(users []messages.User) map[string]int {
+	m := make(map[string]int, len(users))
+	for _, u := range users {
+		m[u.Username] = u.Favnum
+	}
+	return m
+}
+
+func TestSetIsPushedToOtherConnections(t *testing.T) {
+	a, b := dial(t), dial(t)
+	if err := a.SetFavoriteNumber("e2e-push", 7); err != nil {
+		t.Fatal("set:", err)
+	}
+	waitList(t, b, func(m map[string]int) bool { return m["e2e-push"] == 7 })
+
+	if err := b.SetFavoriteNumber("e2e-push", 8); err != nil {
+		t.Fatal("set:", err)
+	}
+	waitList(t, a, func(m map[string]int) bool { return m["e2e-push"] == 8 })
+}
+
+func TestListIsSortedByName(t *testing.T) {
+	c := dial(t)
+	for i, name := range []string{"e2e-sort-c", "e2e-sort-a", "e2e-sort-b"} {
+		if err := c.SetFavoriteNumber(name, i); err != nil {
+			t.Fatal("set:", err)
+		}
+	}
+	list, err := c.ListUsers()
+	if err != nil {
+		t.Fatal("list:", err)
+	}
+	var names []string
+	for _, u := range list.AllUsers {
+		if strings.HasPrefix(u.Username, "e2e-sort-") {
+			names = append(names, u.Username)
+		}
+	}
+	if got := strings.Join(names, ","); got != "e2e-sort-a,e2e-sort-b,e2e-sort-c" {
+		t.Fatal("expected sorted users, got", got)
+	}
+}
+
+func TestGetAndDeleteUser(t *testing.T) {
+	a, b := dial(t), dial(t)
+	if _, err := a.GetUser("e2e-missing"); err != wsclient.ErrNotFound {
+		t.Fatal("expected ErrNotFound, got", err)
+	}
+	if err := a.SetFavoriteNumber("e2e-delete", 3); err != nil {
+		t.Fatal("set:", err)
+	}
+	u, err := a.GetUser("e2e-delete")
+	if err != nil || u.Favnum != 3 {
+		t.Fatal("get:", u, err)
+	}
+	waitList(t, b, func(m map[string]int) bool { return m["e2e-delete"] == 3 })
+	if err := a.DeleteUser("e2e-delete"); err != nil {
+		t.Fatal("delete:", err)
+	}
+	waitList(t, b, func(m map[string]int) bool {
+		_, exists := m["e2e-delete"]
+		return !exists
+	})
+	if _, err := a.GetUser("e2e-delete"); err != wsclient.ErrNotFound {
+		t.Fatal("expected ErrNotFound after delete, got", err)
+	}
+}
+
+func TestRESTSeesWebsocketChanges(t *testing.T) {
+	c := dial(t)
+	if err := c.SetFavoriteNumber("e2e-rest", 42); err != nil {
+		t.Fatal("set:", err)
+	}
+	rp, err := http.Get(web.URL + "/users/e2e-rest")
+	if err != nil {
+		t.Fatal("get:", err)
+	}
+	defer rp.Body.Close()
+	var u messages.User
+	if err := json.NewDecoder(rp.Body).Decode(&u); err != nil || rp.StatusCode != http.StatusOK || u.Favnum != 42 {
+		t.Fatal("rest:", rp.Status, u, err)
+	}
+}
+
+func TestPushChannelsClosedAfterClose(t *testing.T) {
+	c := dial(t)
+	c.Close()
+	done := make(chan bool)
+	go func() {
+		for range c.Lists {
+		}
+		for range c.Events {
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(waitFor):
+		t.Fatal("push channels not closed after Close")
+	}
+}
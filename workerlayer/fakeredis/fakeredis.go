@@ -0,0 +1,1306 @@
+// fakeredis package is in-process redis stand-in for integration tests
+//
+// speaks RESP over TCP and implements commands used by weblayer and workerlayer:
+// pub/sub (SUBSCRIBE, PSUBSCRIBE, PUBLISH), strings, hashes, sets, SORT with BY/GET/ALPHA/LIMIT,
+// MULTI/EXEC, key expiry and keyspace notifications (always on, like notify-keyspace-events KEA)
+package fakeredis
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Server struct {
+	ln net.Listener
+
+	mux     sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]string
+	sets    map[string]map[string]bool
+	zsets   map[string]map[string]float64
+	expires map[string]time.Time
+	clients map[*client]bool
+
+	//sentinel mode - address of monitored master
+	master string
+	//cluster mode - slot ranges of all nodes and other nodes for PUBLISH
+	slots []SlotRange
+	peers []*Server
+	bus   chan [2]string
+
+	done chan bool
+	wg   sync.WaitGroup
+}
+
+// replies queued for client - client that does not read is disconnected when queue is full
+const outputQueue = 4096
+
+type client struct {
+	conn net.Conn
+	out  chan []byte
+
+	//guarded by Server.mux
+	channels map[string]bool
+	patterns map[string]bool
+	multi    [][]string
+	inMulti  bool
+	closed   bool
+	//keys of WATCH - EXEC fails when one of them was changed
+	watched map[string]bool
+	dirty   bool
+}
+
+// start server on random local port
+func Start() (*Server, error) {
+	return StartAddr("127.0.0.1:0")
+}
+
+// start server on given address
+func StartAddr(addr string) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ln:      ln,
+		strings: make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		sets:    make(map[string]map[string]bool),
+		zsets:   make(map[string]map[string]float64),
+		expires: make(map[string]time.Time),
+		clients: make(map[*client]bool),
+		done:    make(chan bool),
+	}
+	s.wg.Add(2)
+	go s.accept()
+	go s.expireLoop()
+	return s, nil
+}
+
+//host:port of server
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// redis://host:port of server
+func (s *Server) URL() string {
+	return "redis://" + s.Addr()
+}
+
+// stop listener and close all clients
+func (s *Server) Close() {
+	s.ln.Close()
+	close(s.done)
+	s.mux.Lock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+	s.mux.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &client{conn: conn, out: make(chan []byte, outputQueue), channels: map[string]bool{}, patterns: map[string]bool{}}
+		s.mux.Lock()
+		s.clients[c] = true
+		s.mux.Unlock()
+		s.wg.Add(2)
+		go s.serve(c)
+		go s.writer(c)
+	}
+}
+
+func (s *Server) expireLoop() {
+	defer s.wg.Done()
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+		s.mux.Lock()
+		now := time.Now()
+		for k, at := range s.expires {
+			if now.After(at) {
+				s.del(k)
+				s.notify(k, "expired")
+			}
+		}
+		s.mux.Unlock()
+	}
+}
+
+// write queued replies to client connection
+func (s *Server) writer(c *client) {
+	defer s.wg.Done()
+	w := bufio.NewWriter(c.conn)
+	for m := range c.out {
+		w.Write(m)
+		//flush when nothing else is queued
+		if len(c.out) == 0 {
+			if err := w.Flush(); err != nil {
+				c.conn.Close()
+			}
+		}
+	}
+}
+
+func (s *Server) serve(c *client) {
+	defer s.wg.Done()
+	defer func() {
+		s.mux.Lock()
+		delete(s.clients, c)
+		close(c.out)
+		c.closed = true
+		s.mux.Unlock()
+		c.conn.Close()
+	}()
+	r := bufio.NewReader(c.conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		s.mux.Lock()
+		if reply := s.exec(c, args); reply != nil {
+			c.write(reply)
+		}
+		s.mux.Unlock()
+	}
+}
+
+/////////////////
+// RESP protocol
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		//inline command
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errors.New("expected bulk string")
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// reply values: string (simple), bulk, nil bulk, int, error, array
+type simple string
+type bulk string
+type nilBulk struct{}
+type nilArray struct{}
+type errReply string
+
+// queue reply for client - caller holds Server.mux
+func (c *client) write(v interface{}) {
+	if c.closed {
+		return
+	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	writeValue(w, v)
+	w.Flush()
+	select {
+	case c.out <- buf.Bytes():
+	default:
+		//output buffer limit reached - like redis, drop client
+		c.conn.Close()
+	}
+}
+
+func writeValue(w *bufio.Writer, v interface{}) {
+	switch x := v.(type) {
+	case simple:
+		fmt.Fprintf(w, "+%s\r\n", string(x))
+	case errReply:
+		fmt.Fprintf(w, "-%s\r\n", string(x))
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", x)
+	case bulk:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(x), string(x))
+	case nilBulk:
+		w.WriteString("$-1\r\n")
+	case nilArray:
+		w.WriteString("*-1\r\n")
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(x))
+		for _, e := range x {
+			writeValue(w, e)
+		}
+	default:
+		panic(fmt.Sprintf("fakeredis: unknown reply %T", v))
+	}
+}
+
+///////////
+// commands
+
+const ok = simple("OK")
+
+func wrongArgs(cmd string) errReply {
+	return errReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+}
+
+// forget watched keys - after EXEC, DISCARD and UNWATCH
+func (c *client) unwatch() {
+	c.watched = nil
+	c.dirty = false
+}
+
+// execute command - caller holds s.mux
+func (s *Server) exec(c *client, args []string) interface{} {
+	cmd := strings.ToUpper(args[0])
+
+	//commands allowed in subscribed state
+	if len(c.channels)+len(c.patterns) > 0 {
+		switch cmd {
+		case "SUBSCRIBE", "UNSUBSCRIBE", "PSUBSCRIBE", "PUNSUBSCRIBE", "PING", "QUIT":
+		default:
+			return errReply("ERR only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context")
+		}
+	}
+
+	if c.inMulti {
+		switch cmd {
+		case "EXEC":
+			c.inMulti = false
+			queued := c.multi
+			c.multi = nil
+			dirty := c.dirty
+			c.unwatch()
+			if dirty {
+				//watched key was changed - transaction is not executed
+				return nilArray{}
+			}
+			replies := make([]interface{}, 0, len(queued))
+			for _, q := range queued {
+				replies = append(replies, s.command(c, q))
+			}
+			return replies
+		case "DISCARD":
+			c.inMulti = false
+			c.multi = nil
+			c.unwatch()
+			return ok
+		case "MULTI":
+			return errReply("ERR MULTI calls can not be nested")
+		case "WATCH":
+			return errReply("ERR WATCH inside MULTI is not allowed")
+		}
+		c.multi = append(c.multi, args)
+		return simple("QUEUED")
+	}
+	return s.command(c, args)
+}
+
+func (s *Server) command(c *client, args []string) interface{} {
+	cmd := strings.ToUpper(args[0])
+	a := args[1:]
+	if moved := s.moved(cmd, a); moved != "" {
+		return errReply(moved)
+	}
+	switch cmd {
+	case "PING":
+		if len(c.channels)+len(c.patterns) > 0 {
+			data := ""
+			if len(a) > 0 {
+				data = a[0]
+			}
+			return []interface{}{bulk("pong"), bulk(data)}
+		}
+		if len(a) > 0 {
+			return bulk(a[0])
+		}
+		return simple("PONG")
+	case "ECHO":
+		if len(a) != 1 {
+			return wrongArgs(cmd)
+		}
+		return bulk(a[0])
+	case "ROLE":
+		if s.master != "" {
+			return []interface{}{bulk("sentinel"), []interface{}{bulk("mymaster")}}
+		}
+		return []interface{}{bulk("master"), 0, []interface{}{}}
+	case "SENTINEL":
+		if s.master == "" {
+			return errReply("ERR unknown command 'SENTINEL'")
+		}
+		if len(a) < 2 {
+			return wrongArgs(cmd)
+		}
+		switch strings.ToUpper(a[0]) {
+		case "GET-MASTER-ADDR-BY-NAME":
+			host, port, _ := net.SplitHostPort(s.master)
+			return []interface{}{bulk(host), bulk(port)}
+		case "FAILOVER-TO":
+			s.setMaster(a[1])
+			return ok
+		}
+		return errReply("ERR unknown sentinel subcommand")
+	case "SELECT", "AUTH", "CLIENT":
+		return ok
+	case "QUIT":
+		return ok
+	case "MULTI":
+		c.inMulti = true
+		return ok
+	case "EXEC", "DISCARD":
+		return errReply("ERR " + cmd + " without MULTI")
+	case "WATCH":
+		if len(a) == 0 {
+			return wrongArgs(cmd)
+		}
+		if c.watched == nil {
+			c.watched = make(map[string]bool)
+		}
+		for _, k := range a {
+			c.watched[k] = true
+		}
+		return ok
+	case "UNWATCH":
+		c.unwatch()
+		return ok
+	case "FLUSHALL", "FLUSHDB":
+		s.strings = make(map[string]string)
+		s.hashes = make(map[string]map[string]string)
+		s.sets = make(map[string]map[string]bool)
+		s.zsets = make(map[string]map[string]float64)
+		s.expires = make(map[string]time.Time)
+		for other := range s.clients {
+			other.dirty = other.dirty || len(other.watched) > 0
+		}
+		return ok
+
+	// pub/sub
+	case "PUBLISH":
+		if len(a) != 2 {
+			return wrongArgs(cmd)
+		}
+		return s.publish(a[0], a[1])
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		if len(a) == 0 {
+			return wrongArgs(cmd)
+		}
+		for _, ch := range a {
+			set := c.channels
+			if cmd == "PSUBSCRIBE" {
+				set = c.patterns
+			}
+			set[ch] = true
+			c.write([]interface{}{bulk(strings.ToLower(cmd)), bulk(ch), len(c.channels) + len(c.patterns)})
+		}
+		return nil
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		set := c.channels
+		if cmd == "PUNSUBSCRIBE" {
+			set = c.patterns
+		}
+		names := a
+		if len(names) == 0 {
+			for ch := range set {
+				names = append(names, ch)
+			}
+			sort.Strings(names)
+		}
+		if len(names) == 0 {
+			c.write([]interface{}{bulk(strings.ToLower(cmd)), nilBulk{}, len(c.channels) + len(c.patterns)})
+		}
+		for _, ch := range names {
+			delete(set, ch)
+			c.write([]interface{}{bulk(strings.ToLower(cmd)), bulk(ch), len(c.channels) + len(c.patterns)})
+		}
+		return nil
+
+	// keys
+	case "DEL":
+		if len(a) == 0 {
+			return wrongArgs(cmd)
+		}
+		n := 0
+		for _, k := range a {
+			if s.del(k) {
+				n++
+				s.notify(k, "del")
+			}
+		}
+		return n
+	case "EXISTS":
+		n := 0
+		for _, k := range a {
+			if s.exists(k) {
+				n++
+			}
+		}
+		return n
+	case "EXPIRE", "PEXPIRE":
+		if len(a) != 2 {
+			return wrongArgs(cmd)
+		}
+		n, err := strconv.Atoi(a[1])
+		if err != nil {
+			return errReply("ERR value is not an integer or out of range")
+		}
+		if !s.exists(a[0]) {
+			return 0
+		}
+		d := time.Duration(n) * time.Second
+		if cmd == "PEXPIRE" {
+			d = time.Duration(n) * time.Millisecond
+		}
+		s.expires[a[0]] = time.Now().Add(d)
+		s.notify(a[0], "expire")
+		return 1
+	case "TTL":
+		if len(a) != 1 {
+			return wrongArgs(cmd)
+		}
+		if !s.exists(a[0]) {
+			return -2
+		}
+		at, exists := s.expires[a[0]]
+		if !exists {
+			return -1
+		}
+		return int(time.Until(at).Seconds() + 0.5)
+	case "KEYS":
+		if len(a) != 1 {
+			return wrongArgs(cmd)
+		}
+		return bulks(s.keys(a[0]))
+	case "SCAN":
+		//single iteration returns everything
+		pattern := "*"
+		for i := 1; i+1 < len(a); i += 2 {
+			if strings.ToUpper(a[i]) == "MATCH" {
+				pattern = a[i+1]
+			}
+		}
+		return []interface{}{bulk("0"), bulks(s.keys(pattern))}
+
+	// strings
+	case "GET":
+		if len(a) != 1 {
+			return wrongArgs(cmd)
+		}
+		v, exists := s.strings[a[0]]
+		if !exists {
+			return nilBulk{}
+		}
+		return bulk(v)
+	case "SET":
+		return s.set(a)
+	case "INCR", "INCRBY":
+		if len(a) < 1 {
+			return wrongArgs(cmd)
+		}
+		by := 1
+		if cmd == "INCRBY" {
+			if len(a) != 2 {
+				return wrongArgs(cmd)
+			}
+			var err error
+			if by, err = strconv.Atoi(a[1]); err != nil {
+				return errReply("ERR value is not an integer or out of range")
+			}
+		}
+		n, _ := strconv.Atoi(s.strings[a[0]])
+		n += by
+		s.strings[a[0]] = strconv.Itoa(n)
+		s.notify(a[0], "incrby")
+		return n
+
+	// hashes
+	case "HSET", "HMSET":
+		if len(a) < 3 || len(a)%2 != 1 {
+			return wrongArgs(cmd)
+		}
+		h := s.hashes[a[0]]
+		if h == nil {
+			h = make(map[string]string)
+			s.hashes[a[0]] = h
+		}
+		added := 0
+		for i := 1; i < len(a); i += 2 {
+			if _, exists := h[a[i]]; !exists {
+				added++
+			}
+			h[a[i]] = a[i+1]
+		}
+		s.notify(a[0], "hset")
+		if cmd == "HMSET" {
+			return ok
+		}
+		return added
+	case "HGET":
+		if len(a) != 2 {
+			return wrongArgs(cmd)
+		}
+		v, exists := s.hashes[a[0]][a[1]]
+		if !exists {
+			return nilBulk{}
+		}
+		return bulk(v)
+	case "HMGET":
+		if len(a) < 2 {
+			return wrongArgs(cmd)
+		}
+		values := make([]interface{}, 0, len(a)-1)
+		for _, f := range a[1:] {
+			if v, exists := s.hashes[a[0]][f]; exists {
+				values = append(values, bulk(v))
+			} else {
+				values = append(values, nilBulk{})
+			}
+		}
+		return values
+	case "HGETALL":
+		if len(a) != 1 {
+			return wrongArgs(cmd)
+		}
+		h := s.hashes[a[0]]
+		fields := make([]string, 0, len(h))
+		for f := range h {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+		values := make([]interface{}, 0, 2*len(h))
+		for _, f := range fields {
+			values = append(values, bulk(f), bulk(h[f]))
+		}
+		return values
+	case "HDEL":
+		if len(a) < 2 {
+			return wrongArgs(cmd)
+		}
+		n := 0
+		for _, f := range a[1:] {
+			if _, exists := s.hashes[a[0]][f]; exists {
+				delete(s.hashes[a[0]], f)
+				n++
+			}
+		}
+		if n > 0 {
+			s.notify(a[0], "hdel")
+			if len(s.hashes[a[0]]) == 0 {
+				s.del(a[0])
+			}
+		}
+		return n
+
+	// sets
+	case "SADD":
+		if len(a) < 2 {
+			return wrongArgs(cmd)
+		}
+		set := s.sets[a[0]]
+		if set == nil {
+			set = make(map[string]bool)
+			s.sets[a[0]] = set
+		}
+		n := 0
+		for _, m := range a[1:] {
+			if !set[m] {
+				set[m] = true
+				n++
+			}
+		}
+		if n > 0 {
+			s.notify(a[0], "sadd")
+		}
+		return n
+	case "SREM":
+		if len(a) < 2 {
+			return wrongArgs(cmd)
+		}
+		n := 0
+		for _, m := range a[1:] {
+			if s.sets[a[0]][m] {
+				delete(s.sets[a[0]], m)
+				n++
+			}
+		}
+		if n > 0 {
+			s.notify(a[0], "srem")
+			if len(s.sets[a[0]]) == 0 {
+				s.del(a[0])
+			}
+		}
+		return n
+	case "SMEMBERS":
+		if len(a) != 1 {
+			return wrongArgs(cmd)
+		}
+		return bulks(s.members(a[0]))
+	case "SCARD":
+		if len(a) != 1 {
+			return wrongArgs(cmd)
+		}
+		return len(s.sets[a[0]])
+	case "SISMEMBER":
+		if len(a) != 2 {
+			return wrongArgs(cmd)
+		}
+		if s.sets[a[0]][a[1]] {
+			return 1
+		}
+		return 0
+
+	case "SORT":
+		return s.sort(a)
+
+	// sorted sets
+	case "ZADD":
+		if len(a) < 3 || len(a)%2 != 1 {
+			return wrongArgs(cmd)
+		}
+		z := s.zsets[a[0]]
+		if z == nil {
+			z = make(map[string]float64)
+			s.zsets[a[0]] = z
+		}
+		n := 0
+		for i := 1; i < len(a); i += 2 {
+			score, err := strconv.ParseFloat(a[i], 64)
+			if err != nil {
+				return errReply("ERR value is not a valid float")
+			}
+			if _, e := z[a[i+1]]; !e {
+				n++
+			}
+			z[a[i+1]] = score
+		}
+		s.notify(a[0], "zadd")
+		return n
+	case "ZREM":
+		if len(a) < 2 {
+			return wrongArgs(cmd)
+		}
+		n := 0
+		for _, m := range a[1:] {
+			if _, e := s.zsets[a[0]][m]; e {
+				delete(s.zsets[a[0]], m)
+				n++
+			}
+		}
+		if n > 0 {
+			s.notify(a[0], "zrem")
+			if len(s.zsets[a[0]]) == 0 {
+				s.del(a[0])
+			}
+		}
+		return n
+	case "ZCARD":
+		if len(a) != 1 {
+			return wrongArgs(cmd)
+		}
+		return len(s.zsets[a[0]])
+	case "ZSCORE":
+		if len(a) != 2 {
+			return wrongArgs(cmd)
+		}
+		score, e := s.zsets[a[0]][a[1]]
+		if !e {
+			return nilBulk{}
+		}
+		return bulk(strconv.FormatFloat(score, 'f', -1, 64))
+	case "ZRANGEBYLEX":
+		if len(a) != 3 {
+			return wrongArgs(cmd)
+		}
+		//all members have same score in lex index - order by member
+		var members []string
+		for m := range s.zsets[a[0]] {
+			if lexAbove(m, a[1]) && lexBelow(m, a[2]) {
+				members = append(members, m)
+			}
+		}
+		sort.Strings(members)
+		return bulks(members)
+	case "ZRANGEBYSCORE":
+		if len(a) != 3 {
+			return wrongArgs(cmd)
+		}
+		min, minEx, err1 := parseScore(a[1])
+		max, maxEx, err2 := parseScore(a[2])
+		if err1 != nil || err2 != nil {
+			return errReply("ERR min or max is not a float")
+		}
+		z := s.zsets[a[0]]
+		var members []string
+		for m, score := range z {
+			if (score > min || !minEx && score == min) && (score < max || !maxEx && score == max) {
+				members = append(members, m)
+			}
+		}
+		sort.Slice(members, func(i, j int) bool {
+			if z[members[i]] != z[members[j]] {
+				return z[members[i]] < z[members[j]]
+			}
+			return members[i] < members[j]
+		})
+		return bulks(members)
+
+	// cluster
+	case "CLUSTER":
+		if len(a) < 1 || strings.ToUpper(a[0]) != "SLOTS" || s.slots == nil {
+			return errReply("ERR This instance has cluster support disabled")
+		}
+		var reply []interface{}
+		for _, sr := range s.slots {
+			host, port, _ := net.SplitHostPort(sr.Addr)
+			p, _ := strconv.Atoi(port)
+			reply = append(reply, []interface{}{sr.Start, sr.End, []interface{}{bulk(host), p, bulk(sr.Addr)}})
+		}
+		return reply
+	case "ASKING", "READONLY":
+		return ok
+	}
+	return errReply(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+}
+
+// SET key value [EX seconds] [PX ms] [NX|XX]
+func (s *Server) set(a []string) interface{} {
+	if len(a) < 2 {
+		return wrongArgs("SET")
+	}
+	var ttl time.Duration
+	nx, xx := false, false
+	for i := 2; i < len(a); i++ {
+		switch strings.ToUpper(a[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 >= len(a) {
+				return errReply("ERR syntax error")
+			}
+			n, err := strconv.Atoi(a[i+1])
+			if err != nil {
+				return errReply("ERR value is not an integer or out of range")
+			}
+			ttl = time.Duration(n) * time.Second
+			if strings.ToUpper(a[i]) == "PX" {
+				ttl = time.Duration(n) * time.Millisecond
+			}
+			i++
+		default:
+			return errReply("ERR syntax error")
+		}
+	}
+	exists := s.exists(a[0])
+	if (nx && exists) || (xx && !exists) {
+		return nilBulk{}
+	}
+	s.del(a[0])
+	s.strings[a[0]] = a[1]
+	if ttl > 0 {
+		s.expires[a[0]] = time.Now().Add(ttl)
+	}
+	s.notify(a[0], "set")
+	return ok
+}
+
+// SORT key [BY pattern] [LIMIT offset count] [GET pattern ...] [ASC|DESC] [ALPHA]
+func (s *Server) sort(a []string) interface{} {
+	if len(a) < 1 {
+		return wrongArgs("SORT")
+	}
+	elements := s.members(a[0])
+	by, gets := "", []string{}
+	alpha, desc := false, false
+	offset, count := 0, -1
+	for i := 1; i < len(a); i++ {
+		switch strings.ToUpper(a[i]) {
+		case "BY":
+			if i+1 >= len(a) {
+				return errReply("ERR syntax error")
+			}
+			by = a[i+1]
+			i++
+		case "GET":
+			if i+1 >= len(a) {
+				return errReply("ERR syntax error")
+			}
+			gets = append(gets, a[i+1])
+			i++
+		case "LIMIT":
+			if i+2 >= len(a) {
+				return errReply("ERR syntax error")
+			}
+			offset, _ = strconv.Atoi(a[i+1])
+			count, _ = strconv.Atoi(a[i+2])
+			i += 2
+		case "ALPHA":
+			alpha = true
+		case "ASC":
+		case "DESC":
+			desc = true
+		default:
+			return errReply("ERR syntax error")
+		}
+	}
+
+	weight := func(e string) string {
+		if by == "" {
+			return e
+		}
+		v, _ := s.lookup(by, e)
+		return v
+	}
+	//equal weights are compared by element like redis, DESC reverses both
+	sort.SliceStable(elements, func(i, j int) bool {
+		wi, wj := weight(elements[i]), weight(elements[j])
+		cmp := strings.Compare(wi, wj)
+		if !alpha {
+			fi, _ := strconv.ParseFloat(wi, 64)
+			fj, _ := strconv.ParseFloat(wj, 64)
+			cmp = 0
+			if fi < fj {
+				cmp = -1
+			} else if fi > fj {
+				cmp = 1
+			}
+		}
+		if cmp == 0 {
+			cmp = strings.Compare(elements[i], elements[j])
+		}
+		if desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+
+	if offset > len(elements) {
+		offset = len(elements)
+	}
+	elements = elements[offset:]
+	if count >= 0 && count < len(elements) {
+		elements = elements[:count]
+	}
+
+	if len(gets) == 0 {
+		return bulks(elements)
+	}
+	values := make([]interface{}, 0, len(elements)*len(gets))
+	for _, e := range elements {
+		for _, g := range gets {
+			if v, exists := s.lookup(g, e); exists {
+				values = append(values, bulk(v))
+			} else {
+				values = append(values, nilBulk{})
+			}
+		}
+	}
+	return values
+}
+
+// resolve SORT BY/GET pattern for element - "#", "key_*" or "hash_*->field"
+func (s *Server) lookup(pattern, e string) (string, bool) {
+	if pattern == "#" {
+		return e, true
+	}
+	field := ""
+	if i := strings.Index(pattern, "->"); i >= 0 {
+		pattern, field = pattern[:i], pattern[i+2:]
+	}
+	key := strings.Replace(pattern, "*", e, 1)
+	if field != "" {
+		v, exists := s.hashes[key][field]
+		return v, exists
+	}
+	v, exists := s.strings[key]
+	return v, exists
+}
+
+////////////////
+// data helpers
+
+func (s *Server) exists(k string) bool {
+	if _, e := s.strings[k]; e {
+		return true
+	}
+	if _, e := s.hashes[k]; e {
+		return true
+	}
+	if _, e := s.zsets[k]; e {
+		return true
+	}
+	_, e := s.sets[k]
+	return e
+}
+
+func (s *Server) del(k string) bool {
+	existed := s.exists(k)
+	delete(s.strings, k)
+	delete(s.hashes, k)
+	delete(s.sets, k)
+	delete(s.zsets, k)
+	delete(s.expires, k)
+	return existed
+}
+
+func (s *Server) keys(pattern string) []string {
+	var keys []string
+	add := func(k string) {
+		if Match(pattern, k) {
+			keys = append(keys, k)
+		}
+	}
+	for k := range s.strings {
+		add(k)
+	}
+	for k := range s.hashes {
+		add(k)
+	}
+	for k := range s.sets {
+		add(k)
+	}
+	for k := range s.zsets {
+		add(k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Server) members(k string) []string {
+	members := make([]string, 0, len(s.sets[k]))
+	for m := range s.sets[k] {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	return members
+}
+
+func bulks(values []string) []interface{} {
+	r := make([]interface{}, len(values))
+	for i, v := range values {
+		r[i] = bulk(v)
+	}
+	return r
+}
+
+////////////////////////////
+// pub/sub and notifications
+
+// run as sentinel of master at addr
+func (s *Server) SetMaster(addr string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.setMaster(addr)
+}
+
+// switch master and announce +switch-master - caller holds s.mux
+func (s *Server) setMaster(addr string) {
+	old := s.master
+	s.master = addr
+	if old == "" || old == addr {
+		return
+	}
+	oh, op, _ := net.SplitHostPort(old)
+	nh, np, _ := net.SplitHostPort(addr)
+	s.publish("+switch-master", strings.Join([]string{"mymaster", oh, op, nh, np}, " "))
+}
+
+// deliver message to subscribers of all cluster nodes - caller holds s.mux
+func (s *Server) publish(channel, message string) int {
+	for _, p := range s.peers {
+		select {
+		case p.bus <- [2]string{channel, message}:
+		default:
+		}
+	}
+	return s.publishLocal(channel, message)
+}
+
+// deliver message to subscribers of this node - caller holds s.mux
+func (s *Server) publishLocal(channel, message string) int {
+	n := 0
+	for c := range s.clients {
+		if c.channels[channel] {
+			c.write([]interface{}{bulk("message"), bulk(channel), bulk(message)})
+			n++
+		}
+		for p := range c.patterns {
+			if Match(p, channel) {
+				c.write([]interface{}{bulk("pmessage"), bulk(p), bulk(channel), bulk(message)})
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// keyspace and keyevent notification for db 0 - sent on every change of key,
+// so it also fails transactions of clients that watch the key
+func (s *Server) notify(key, event string) {
+	for c := range s.clients {
+		if c.watched[key] {
+			c.dirty = true
+		}
+	}
+	//node local like in redis cluster
+	s.publishLocal("__keyspace@0__:"+key, event)
+	s.publishLocal("__keyevent@0__:"+event, key)
+}
+
+// redis glob style match - supports *, ? and [...]
+func Match(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if Match(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		case '[':
+			end := strings.IndexByte(pattern, ']')
+			if end < 0 || len(s) == 0 {
+				return false
+			}
+			class := pattern[1:end]
+			negate := len(class) > 0 && class[0] == '^'
+			if negate {
+				class = class[1:]
+			}
+			matched := false
+			for i := 0; i < len(class); i++ {
+				if i+2 < len(class) && class[i+1] == '-' {
+					if class[i] <= s[0] && s[0] <= class[i+2] {
+						matched = true
+					}
+					i += 2
+				} else if class[i] == s[0] {
+					matched = true
+				}
+			}
+			if matched == negate {
+				return false
+			}
+			pattern, s = pattern[end+1:], s[1:]
+		case '\\':
+			if len(pattern) < 2 || len(s) == 0 || pattern[1] != s[0] {
+				return false
+			}
+			pattern, s = pattern[2:], s[1:]
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+// score bound of ZRANGEBYSCORE - "-inf", "+inf", "1.5" inclusive or "(1.5" exclusive
+func parseScore(v string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(v, "(")
+	v = strings.TrimPrefix(v, "(")
+	switch v {
+	case "-inf":
+		return math.Inf(-1), exclusive, nil
+	case "+inf", "inf":
+		return math.Inf(1), exclusive, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	return f, exclusive, err
+}
+
+// min of ZRANGEBYLEX - "-", "[m" inclusive or "(m" exclusive
+func lexAbove(m, min string) bool {
+	switch {
+	case min == "-":
+		return true
+	case min == "+":
+		return false
+	case strings.HasPrefix(min, "("):
+		return m > min[1:]
+	}
+	return m >= strings.TrimPrefix(min, "[")
+}
+
+// max of ZRANGEBYLEX - "+", "[m" inclusive or "(m" exclusive
+func lexBelow(m, max string) bool {
+	switch {
+	case max == "+":
+		return true
+	case max == "-":
+		return false
+	case strings.HasPrefix(max, "("):
+		return m < max[1:]
+	}
+	return m <= strings.TrimPrefix(max, "[")
+}
+
+//////////////////////////////////////////////////////
+// cluster mode
+
+// slots served by node at Addr
+type SlotRange struct {
+	Start, End int
+	Addr       string
+}
+
+// commands without key - allowed on every cluster node
+var keyless = map[string]bool{
+	"PING": true, "ECHO": true, "AUTH": true, "SELECT": true, "CLIENT": true, "ROLE": true, "CLUSTER": true,
+	"ASKING": true, "READONLY": true, "QUIT": true, "MULTI": true, "EXEC": true, "DISCARD": true,
+	"PUBLISH": true, "SUBSCRIBE": true, "PSUBSCRIBE": true, "UNSUBSCRIBE": true, "PUNSUBSCRIBE": true,
+	"FLUSHALL": true, "FLUSHDB": true, "KEYS": true, "SCAN": true, "SENTINEL": true,
+}
+
+// start cluster of nodes on addrs with slots split evenly
+func StartCluster(addrs ...string) ([]*Server, error) {
+	var nodes []*Server
+	for _, addr := range addrs {
+		s, err := StartAddr(addr)
+		if err != nil {
+			for _, n := range nodes {
+				n.Close()
+			}
+			return nil, err
+		}
+		nodes = append(nodes, s)
+	}
+	var slots []SlotRange
+	per := 16384 / len(nodes)
+	for i, n := range nodes {
+		end := (i+1)*per - 1
+		if i == len(nodes)-1 {
+			end = 16383
+		}
+		slots = append(slots, SlotRange{Start: i * per, End: end, Addr: n.Addr()})
+	}
+	for _, n := range nodes {
+		n.mux.Lock()
+		n.slots = slots
+		n.bus = make(chan [2]string, outputQueue)
+		for _, p := range nodes {
+			if p != n {
+				n.peers = append(n.peers, p)
+			}
+		}
+		n.mux.Unlock()
+		go n.busLoop()
+	}
+	return nodes, nil
+}
+
+// MOVED error when key of command belongs to other node - "" otherwise
+func (s *Server) moved(cmd string, a []string) string {
+	if s.slots == nil || keyless[cmd] || len(a) == 0 {
+		return ""
+	}
+	slot := Slot(a[0])
+	for _, sr := range s.slots {
+		if slot >= sr.Start && slot <= sr.End && sr.Addr != s.Addr() {
+			return fmt.Sprintf("MOVED %d %s", slot, sr.Addr)
+		}
+	}
+	return ""
+}
+
+// deliver PUBLISH of other nodes to local subscribers
+func (s *Server) busLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case m := <-s.bus:
+			s.mux.Lock()
+			s.publishLocal(m[0], m[1])
+			s.mux.Unlock()
+		}
+	}
+}
+
+// slot of key - hash tag aware CRC16 like redis cluster
+func Slot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for b := 0; b < 8; b++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return int(crc % 16384)
+}
@@ -0,0 +1,132 @@
+package fakeredis
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func dial(t *testing.T) redis.Conn {
+	t.Helper()
+	s, err := Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	c, err := redis.DialURL(s.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestSortByGetAlpha(t *testing.T) {
+	c := dial(t)
+	for name, num := range map[string]int{"carol": 1, "alice": 3, "bob": 2} {
+		c.Do("SADD", "users", name)
+		c.Do("HMSET", "user:"+name, "favnum", num)
+	}
+
+	c.Do("HMSET", "user:alice", "username", "alice")
+	c.Do("HMSET", "user:bob", "username", "bob")
+	c.Do("HMSET", "user:carol", "username", "carol")
+
+	//query of worker
+	got, err := redis.Strings(c.Do("SORT", "users", "ALPHA", "BY", "user:*->username", "GET", "#", "GET", "user:*->favnum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, " ") != "alice 3 bob 2 carol 1" {
+		t.Fatal("sort alpha:", got)
+	}
+
+	got, err = redis.Strings(c.Do("SORT", "users", "BY", "user:*->favnum", "DESC", "LIMIT", 0, 2, "GET", "#"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, " ") != "alice bob" {
+		t.Fatal("sort by field:", got)
+	}
+}
+
+func TestPubSubAndKeyspaceNotifications(t *testing.T) {
+	s, err := Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, _ := redis.DialURL(s.URL())
+	defer c.Close()
+	sc, err := redis.DialURL(s.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	psc := redis.PubSubConn{Conn: sc}
+	defer psc.Close()
+
+	psc.PSubscribe("__keyspace@0__:user:*")
+	psc.Subscribe("news")
+	for i := 0; i < 2; i++ {
+		if _, ok := psc.Receive().(redis.Subscription); !ok {
+			t.Fatal("expected subscription confirmation")
+		}
+	}
+
+	if n, _ := redis.Int(c.Do("PUBLISH", "news", "hello")); n != 1 {
+		t.Fatal("expected 1 receiver, got", n)
+	}
+	c.Do("HMSET", "user:ana", "favnum", 5)
+
+	//fail instead of hanging when notification is missing
+	done := make(chan bool)
+	go func() {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			psc.Close()
+		}
+	}()
+	defer close(done)
+
+	if m, ok := psc.Receive().(redis.Message); !ok || string(m.Data) != "hello" {
+		t.Fatal("expected message on news, got", m)
+	}
+	if m, ok := psc.Receive().(redis.PMessage); !ok || m.Channel != "__keyspace@0__:user:ana" || string(m.Data) != "hset" {
+		t.Fatal("expected hset notification, got", m)
+	}
+}
+
+func TestWatchFailsExecAfterChange(t *testing.T) {
+	s, err := Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, _ := redis.DialURL(s.URL())
+	defer c.Close()
+	other, _ := redis.DialURL(s.URL())
+	defer other.Close()
+
+	//untouched watched key - transaction runs
+	c.Do("WATCH", "user:ana")
+	c.Send("MULTI")
+	c.Send("SET", "done", "1")
+	if _, err := redis.Values(c.Do("EXEC")); err != nil {
+		t.Fatal("expected EXEC to run, got", err)
+	}
+
+	//key changed by other client between WATCH and EXEC - nil reply
+	c.Do("WATCH", "user:ana")
+	other.Do("HSET", "user:ana", "c1", 1)
+	c.Send("MULTI")
+	c.Send("SET", "done", "2")
+	if _, err := redis.Values(c.Do("EXEC")); err != redis.ErrNil {
+		t.Fatal("expected ErrNil from EXEC, got", err)
+	}
+	if v, _ := redis.String(c.Do("GET", "done")); v != "1" {
+		t.Fatal("aborted transaction was executed, done is", v)
+	}
+}
@@ -0,0 +1,99 @@
+// health package serves liveness and readiness endpoints for both layers
+//
+// /healthz - process is alive, always 200
+// /readyz  - all registered checks pass, 200 or 503 with failing checks listed
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Check returns nil when component is ready
+type Check func() error
+
+type Checker struct {
+	mux    sync.Mutex
+	names  []string
+	checks map[string]Check
+}
+
+func New() *Checker {
+	return &Checker{checks: make(map[string]Check)}
+}
+
+//add named readiness check - checks are run in order of adding
+func (h *Checker) Add(name string, c Check) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if _, exists := h.checks[name]; !exists {
+		h.names = append(h.names, name)
+	}
+	h.checks[name] = c
+}
+
+//register /healthz and /readyz on mux
+func (h *Checker) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", h.Healthz)
+	mux.HandleFunc("/readyz", h.Readyz)
+}
+
+//liveness - if we can answer we are alive
+func (h *Checker) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+//readiness - run all checks, 503 if any of them fails
+func (h *Checker) Readyz(w http.ResponseWriter, r *http.Request) {
+	h.mux.Lock()
+	names := append([]string(nil), h.names...)
+	checks := make([]Check, len(names))
+	for i, n := range names {
+		checks[i] = h.checks[n]
+	}
+	h.mux.Unlock()
+
+	status := http.StatusOK
+	lines := make([]string, len(names))
+	for i, c := range checks {
+		if err := c(); err != nil {
+			status = http.StatusServiceUnavailable
+			lines[i] = fmt.Sprintf("%s: %v", names[i], err)
+			continue
+		}
+		lines[i] = fmt.Sprintf("%s: ok", names[i])
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	for _, l := range lines {
+		fmt.Fprintln(w, l)
+	}
+}
+
+/////////////////
+// common checks
+
+//PING redis through pool
+func RedisPing(pool *redis.Pool) Check {
+	return func() error {
+		rc := pool.Get()
+		defer rc.Close()
+		_, err := rc.Do("PING")
+		return err
+	}
+}
+
+//fails when stopping returns true
+func NotShuttingDown(stopping func() bool) Check {
+	return func() error {
+		if stopping() {
+			return fmt.Errorf("shutting down")
+		}
+		return nil
+	}
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
-	"fmt"
+	"encoding/json"
+	"errors"
+	"log"
 	"strings"
 	"sync"
 	"time"
 	"workerlayer/messages"
+	"workerlayer/presence"
+	"workerlayer/redisconn"
+	"workerlayer/store"
+	"workerlayer/trace"
 	"workerlayer/unmarshall"
 	"workerlayer/usage"
 	"workerlayer/utl"
@@ -13,192 +19,421 @@ import (
 	"github.com/garyburd/redigo/redis"
 )
 
-var pscmap map[string]redis.PubSubConn
+//change notifications of connections by connid
+var watchers = make(map[string]store.Watcher)
 var mux sync.Mutex
 
+//users and favorite numbers - processMessage reads and writes users only through it (online users come from presence)
+var userStore store.UserStore
+
+//client of connection by connid - from init, removed on closed
+var clients = make(map[string]messages.ConnInfo)
+
+//in flight processMessage and running pushKeyChanges go routines - shutdown waits for them
+var inflight sync.WaitGroup
+var pushers sync.WaitGroup
+
 func main() {
-	pscmap = make(map[string]redis.PubSubConn, 0)
-	initRedis()
+	cfg, err := usage.Load()
+	if err != nil {
+		log.Fatal("config: ", err)
+	}
+	utl.ConfigureLog(cfg.Log)
+	for _, line := range cfg.Print() {
+		utl.INFO("config", line)
+	}
+	if err := trace.Init(cfg.Tracing, "workerlayer"); err != nil {
+		log.Fatal("tracing: ", err)
+	}
+
+	initRedis(cfg.Redis)
+	initStore(cfg.Store, len(cfg.Redis.Cluster.Addrs) > 0)
+	go startStatusServer(cfg.Port)
+	go handleSignals()
 	readConnMessages()
+	//consuming stopped - finish what is already processing
+	drain(shutdownWait)
+	trace.Flush(time.Second)
 }
 
-//subscribe on channel "conn.*""
+// delay before subscription is re-established when connection to redis is lost
+const reconnectDelay = time.Second
+
+//consume channel "conn.*" until shutdown - subscription is re-established when connection is lost (e.g. failover)
 func readConnMessages() {
+	for {
+		consumeConnMessages()
+		if shuttingDown() {
+			return
+		}
+		time.Sleep(reconnectDelay)
+		if shuttingDown() {
+			return
+		}
+		resubscribes.Inc("conn")
+		utl.WARN("conn.* subscription lost - subscribing again")
+	}
+}
+
+//subscribe on channel "conn.*" and process messages until unsubscribe or error
+func consumeConnMessages() {
 
 	rc := Pool.Get()
 	defer rc.Close()
 	psc := redis.PubSubConn{Conn: rc}
-
+	//store conn so shutdown can unsubscribe - signal that came before it was stored is seen here,
+	//later one waits for subscribe and unsubscribes
+	mux.Lock()
+	if shuttingDown() {
+		mux.Unlock()
+		return
+	}
+	connpsc = &psc
 	err := psc.PSubscribe("conn.*")
+	mux.Unlock()
+	defer func() {
+		mux.Lock()
+		connpsc = nil
+		mux.Unlock()
+	}()
+
 	if err != nil {
 		utl.ERR("psub", err)
+		return
 	}
 	utl.INFO("worker subscribed on redis channel conn.*")
+
+	//ping subscription so readiness knows loop is alive
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		pinger := time.NewTicker(pingPeriod)
+		defer pinger.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-pinger.C:
+				//one writer at a time - shutdown unsubscribes on the same connection
+				mux.Lock()
+				psc.Ping("")
+				mux.Unlock()
+			}
+		}
+	}()
+
 	for {
 		reply := psc.Receive()
-		if err != nil {
-			utl.ERR("Recieve failed", err)
-			return
-		}
 		//utl.WARN(reply)
 		// process pushed message
 		switch n := reply.(type) {
 		case error:
-			utl.ERR("reply err", err)
+			utl.ERR("reply err", n)
 			return
 		case redis.Message:
 			utl.INFO("Standard message:", n.Channel, string(n.Data))
+		case redis.Pong:
+			pong()
 		case redis.Subscription:
 			utl.INFO("Un/Subscription message-->", n.Kind, n.Channel)
+			if n.Kind == "psubscribe" {
+				pong()
+			}
+			if n.Kind == "punsubscribe" && n.Count == 0 {
+				//shutdown - stop consuming
+				return
+			}
 		case redis.PMessage:
 			//scale - run processMessage in separate go routine
-			go processMessage(n)
+			inflight.Add(1)
+			inflightGauge.Inc()
+			go func() {
+				defer inflight.Done()
+				defer inflightGauge.Dec()
+				processMessage(n)
+			}()
 		}
 	}
 }
 
 func processMessage(n redis.PMessage) {
 
-	utl.INFO("Process message", "channel:", n.Channel, "data:", string(n.Data))
-
 	s := strings.Split(n.Channel, ".")
 	id := s[1]
+	l := utl.With(utl.Fields{ConnID: id, RemoteAddr: client(id)})
 	//special case message - init
 	//little hack to init channel and to send message back to connection that has not sent anything to the worker, only latently connected
-	if string(n.Data) == "init" {
-		go pushKeyChanges(id)
+	if info, ok := parseInit(n.Data); ok {
+		l.With(utl.Fields{RemoteAddr: info.ClientIP}).INFO("Process message", "init", info.User)
+		mux.Lock()
+		clients[id] = info
+		mux.Unlock()
+		messagesIn.Inc("init")
+		pushers.Add(1)
+		pushersGauge.Inc()
+		go func() {
+			defer pushers.Done()
+			defer pushersGauge.Dec()
+			pushKeyChanges(id)
+		}()
 		return
 	}
 	//special case message - closed
 	//whn client lost connection - kill go routines
-	if string(n.Data) == "closed" {
+	if string(n.Data) == messages.ClosedMessage {
+		l.INFO("Process message", "closed")
+		messagesIn.Inc("closed")
 
 		mux.Lock()
-		if sc, exists := pscmap[id]; exists {
-			sc.PUnsubscribe("*keyspace*:user:*")
-			delete(pscmap, id)
+		delete(clients, id)
+		if w, exists := watchers[id]; exists {
+			w.Close()
+			delete(watchers, id)
 		}
 		mux.Unlock()
 		return
 	}
 
+	l.INFO("Process message", "data:", string(n.Data))
+
 	request := unmarshall.Unmarshall(n.Data)
 	if request == nil {
-		utl.ERR("invalid json")
+		messagesIn.Inc("invalid")
+		l.ERR("invalid json")
 		return
 	}
+	messagesIn.Inc(request.Request().String())
 
+	rid := request.ID()
+	l = l.With(utl.Fields{RequestID: rid, Cmd: request.Request().String()})
+	start := time.Now()
+	defer func() { l.With(utl.Fields{Duration: time.Since(start)}).INFO("Processed message") }()
+	//continues trace of weblayer.request - replies carry traceparent of this span
+	span := trace.Start("worker.process", trace.KindConsumer, request.Trace())
+	span.SetAttr("conn_id", id)
+	span.SetAttr("cmd", request.Request().String())
+	if rid != "" {
+		span.SetAttr("request_id", rid)
+	}
+	defer span.End()
 	switch request.Request() {
 	case messages.RQSetFavoriteNumber:
 		//update number
 		cmd := request.(messages.ClientSetFavoriteNumber)
 		cmdData := cmd.CmdData
-		setData(cmdData)
+		rp := reply(messages.SrvSetFavoriteNumber, rid, span)
+		if err := setData(cmdData, span); err != nil {
+			span.SetError(err)
+			rp = replyError(messages.SrvSetFavoriteNumber, rid, err, span)
+		}
+		//changes are pushed on change notification - acknowledge only when client asked for it
+		if rid != "" {
+			publish(id, utl.JSON(rp), rp.Cmd)
+		}
 	case messages.RQListAllUsers:
 		//notify all users connections with sorted list
 		//extract ID from channel name
-		rpl := Pool.Get()
-		rpl.Send("PUBLISH", "worker."+id, string(utl.JSON(getAllUsers())))
-		rpl.Flush()
-		rpl.Close()
+		publish(id, utl.JSON(userList(rid, span)), messages.SrvListAllUsers)
+	case messages.RQGetUser:
+		cmd := request.(messages.ClientGetUser)
+		rp := messages.UserReply{Reply: reply(messages.SrvGetUser, rid, span)}
+		user, err := userStore.Get(cmd.CmdData.UserName)
+		if err != nil {
+			span.SetError(err)
+			rp.Reply = replyError(messages.SrvGetUser, rid, err, span)
+		}
+		rp.User = user
+		publish(id, utl.JSON(rp), rp.Cmd)
+	case messages.RQDeleteUser:
+		cmd := request.(messages.ClientDeleteUser)
+		rp := reply(messages.SrvDeleteUser, rid, span)
+		if err := userStore.Delete(cmd.CmdData.UserName); err != nil {
+			span.SetError(err)
+			rp = replyError(messages.SrvDeleteUser, rid, err, span)
+		}
+		publish(id, utl.JSON(rp), rp.Cmd)
+	case messages.RQListOnline:
+		rp := messages.OnlineUsers{Reply: reply(messages.SrvOnlineUsers, rid, span)}
+		users, err := presence.Online(Pool)
+		if err != nil {
+			l.ERR("listOnline", err)
+			span.SetError(err)
+			rp.Reply = replyError(messages.SrvOnlineUsers, rid, err, span)
+		}
+		rp.Users = users
+		if rp.Users == nil {
+			rp.Users = []string{}
+		}
+		publish(id, utl.JSON(rp), rp.Cmd)
 	}
 
 }
 
+//"init" of connection with optional client info
+func parseInit(m []byte) (messages.ConnInfo, bool) {
+	info := messages.ConnInfo{}
+	data := string(m)
+	if data == messages.InitMessage {
+		return info, true
+	}
+	if !strings.HasPrefix(data, messages.InitMessage+" ") {
+		return info, false
+	}
+	if err := json.Unmarshal(m[len(messages.InitMessage)+1:], &info); err != nil {
+		utl.WARN("init", "invalid client info", data)
+	}
+	return info, true
+}
+
+//client IP of connection for logs - "" for REST requests and old weblayers
+func client(id string) string {
+	mux.Lock()
+	defer mux.Unlock()
+	return clients[id].ClientIP
+}
+
 //subscribe on redis events when change happens on keys
 //in case of change send all users and favorite numbers to client, over channel
+//subscription is re-established until connection is closed or worker shuts down
 func pushKeyChanges(id string) {
-
-	rc := Pool.Get()
-	//defer rc.Close()
-
 	defer utl.INFO("pushKey goroutine ended", id)
 
-	psc := redis.PubSubConn{Conn: rc}
+	for resubscribe := false; ; resubscribe = true {
+		if !watchKeyChanges(id, resubscribe) {
+			return
+		}
+		time.Sleep(reconnectDelay)
+		resubscribes.Inc("keyspace")
+	}
+}
 
-	//store conn in map
-	mux.Lock()
-	pscmap[id] = psc
-	mux.Unlock()
+//one change notification subscription of connection - true when it was lost and should be established again
+func watchKeyChanges(id string, resubscribe bool) bool {
 
-	err := psc.PSubscribe("*keyspace*:user:*")
+	w, err := userStore.Watch()
 	if err != nil {
 		utl.ERR("pushKeyChanges", err)
-		return
+		return connOpen(id)
 	}
-	utl.INFO("Subscribe on *keyspace*:user:*")
-	for {
-		reply := psc.Receive()
-		if err != nil {
-			utl.ERR("Recieve failed", err)
-			return
-		}
-		// process pushed message
-		switch n := reply.(type) {
-		case error:
-			return
-		case redis.Message:
-		case redis.Subscription:
-			if n.Kind == "punsubscribe" {
-				return
-			}
-		case redis.PMessage:
-			rpl := Pool.Get()
-			rpl.Send("PUBLISH", "worker."+id, string(utl.JSON(getAllUsers())))
-			rpl.Flush()
-			rpl.Close()
+	//store watcher in map - connection may be closed while subscribing
+	mux.Lock()
+	if _, exists := clients[id]; !exists || shuttingDown() {
+		mux.Unlock()
+		w.Close()
+		for range w.Changes() {
 		}
+		return false
+	}
+	watchers[id] = w
+	mux.Unlock()
+
+	utl.INFO("Subscribe on change notifications", id)
+	//changes while subscription was lost are not known - push current list
+	if resubscribe {
+		publish(id, utl.JSON(userList("", nil)), messages.SrvListAllUsers)
+	}
+	for change := range w.Changes() {
+		pushes.Inc()
+		push(id, change.TraceParent)
 	}
+	if err := w.Err(); err != nil {
+		utl.ERR("pushKeyChanges", id, err)
+		return connOpen(id)
+	}
+	return false
 }
 
-func setData(data messages.SetFavoriteNumber) {
-	rc := Pool.Get()
-	defer rc.Close()
+//push current list to connection - in trace of change when parent is known
+func push(id, parent string) {
+	var span *trace.Span
+	if parent != "" {
+		span = trace.Start("worker.push", trace.KindProducer, parent)
+		span.SetAttr("conn_id", id)
+		defer span.End()
+	}
+	publish(id, utl.JSON(userList("", span)), messages.SrvListAllUsers)
+}
 
-	namekey := fmt.Sprintf("user:%s", data.UserName)
-	rc.Send("HMSET", namekey, "username", data.UserName, "favnum", data.FavoriteNumber)
-	rc.Send("SADD", "users", data.UserName)
-	rc.Flush()
+//connection still wants pushes - not closed and worker is not shutting down
+func connOpen(id string) bool {
+	mux.Lock()
+	_, exists := clients[id]
+	mux.Unlock()
+	return exists && !shuttingDown()
 }
 
-func getAllUsers() []messages.User {
-	rc := Pool.Get()
-	defer rc.Close()
+//send reply to connection over channel worker.{connid}
+func publish(id string, payload []byte, rp messages.RPEnum) {
+	defer publishSeconds.ObserveSince(time.Now())
+	rpl := Pool.Get()
+	defer rpl.Close()
 
-	var users []messages.User
+	if _, err := rpl.Do("PUBLISH", "worker."+id, string(payload)); err != nil {
+		utl.ERR("publish", id, err)
+		return
+	}
+	messagesOut.Inc(rp.String())
+}
 
-	utl.INFO("get values")
-	values, err := redis.Values(rc.Do("SORT", "users", "ALPHA",
-		"BY", "user:*->username",
-		"GET", "user:*->username",
-		"GET", "user:*->favnum"))
-	if err != nil {
-		utl.ERR(err)
-		return users
+//successful reply - span is nil when tracing is off
+func reply(rp messages.RPEnum, rid string, span *trace.Span) messages.Reply {
+	return messages.Reply{Cmd: rp, Status: messages.StatusOK, RequestID: rid, TraceParent: span.TraceParent()}
+}
+
+//failed reply
+func replyError(rp messages.RPEnum, rid string, err error, span *trace.Span) messages.Reply {
+	return messages.Reply{Cmd: rp, Status: messages.StatusNOTOK, Error: err.Error(), RequestID: rid, TraceParent: span.TraceParent()}
+}
+
+//sorted list of all users wrapped in reply
+func userList(rid string, span *trace.Span) messages.AllUserlist {
+	seq, users := getAllUsers()
+	return messages.AllUserlist{Reply: reply(messages.SrvListAllUsers, rid, span), Seq: seq, AllUsers: users}
+}
+
+//store favorite number - traceparent of write is stored with change, so pushes continue its trace
+func setData(data messages.SetFavoriteNumber, parent *trace.Span) error {
+	if data.UserName == "" {
+		return errors.New("empty username")
 	}
+	var span *trace.Span
+	if parent != nil {
+		span = trace.Start("worker.setData", trace.KindClient, parent.TraceParent())
+		span.SetAttr("user", data.UserName)
+		defer span.End()
+	}
+	err := userStore.Set(messages.User{Username: data.UserName, Favnum: data.FavoriteNumber}, span.TraceParent())
+	span.SetError(err)
+	return err
+}
 
-	if err := redis.ScanSlice(values, &users); err != nil {
-		utl.ERR("ScanSlice - getallusers error", err)
-		return users
+//all users sorted by name and version of list
+func getAllUsers() (int64, []messages.User) {
+	defer getAllSeconds.ObserveSince(time.Now())
+	list, err := userStore.List(store.Query{})
+	if err != nil {
+		utl.ERR("getAllUsers", err)
 	}
-	return users
+	return list.Seq, list.Users
 }
 
 /////////////////redis conn pool
 ///////////////////////////////////
 var Pool *redis.Pool
 
-func newPool(redisURL string) *redis.Pool {
-	return &redis.Pool{
-		MaxIdle:     3,
-		IdleTimeout: 240 * time.Second,
-		Dial:        func() (redis.Conn, error) { return redis.DialURL(redisURL) },
-	}
-}
-
-func initRedis() {
+func initRedis(opts redisconn.Options) {
 	//connect to redis && create pool
-	redisURL := fmt.Sprintf("redis://%s:6379", usage.Redis())
-	Pool = newPool(redisURL)
+	utl.INFO("Connecting to redis ->", opts)
+	Pool = redisconn.NewPool(opts)
 
 }
+
+//user data in redis shared by all workers or in memory of this worker - redis is still used for messages
+func initStore(kind string, cluster bool) {
+	utl.INFO("User store ->", kind)
+	if kind == usage.StoreMemory {
+		userStore = store.NewMemory()
+		return
+	}
+	userStore = store.NewRedis(Pool, cluster)
+}
@@ -7,8 +7,24 @@ type RPEnum int
 const (
 	Empty RPEnum = iota
 	SrvListAllUsers
+	SrvSetFavoriteNumber
+	SrvGetUser
+	SrvDeleteUser
+	SrvSession
+	SrvAnnouncement
+	SrvOnlineUsers
+	SrvPresence
 )
 
+// reply status
+const (
+	StatusOK    = "OK"
+	StatusNOTOK = "NOTOK"
+)
+
+// Reply.Error when requested user does not exist
+const ErrUserNotFound = "user not found"
+
 type User struct {
 	Username string
 	Favnum   int
@@ -19,9 +35,57 @@ type Reply struct {
 	Cmd    RPEnum
 	Status string //OK or NOTOK
 	Error  string
+	//RequestID of request this is reply to - empty for pushes
+	RequestID string `json:",omitempty"`
+	//W3C traceparent of span that produced reply or push
+	TraceParent string `json:",omitempty"`
 }
 
 type AllUserlist struct {
 	Reply
+	//version of list - incremented on every change, same list has same Seq
+	Seq      int64
 	AllUsers []User
 }
+
+//reply to get user
+type UserReply struct {
+	Reply
+	User User
+}
+
+//sent by weblayer on connect - token resumes session on reconnect (?session=token)
+type Session struct {
+	Reply
+	Token string
+	//true when session was restored from token
+	Resumed bool
+}
+
+//sent by weblayer when admin announces something to all clients or to targeted users/tags
+type Announcement struct {
+	Reply
+	Text string
+	//e.g. info, warning - client decides how to show it
+	Level string `json:",omitempty"`
+}
+
+//reply to list online users
+type OnlineUsers struct {
+	Reply
+	//sorted authenticated users with at least one live connection
+	Users []string
+}
+
+// Presence.Event
+const (
+	PresenceJoin  = "join"
+	PresenceLeave = "leave"
+)
+
+//pushed to connections subscribed on presence when user comes online or goes offline
+type Presence struct {
+	Reply
+	User  string
+	Event string
+}
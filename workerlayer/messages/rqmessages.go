@@ -11,23 +11,40 @@ const (
 	RQUnknown RQEnum = iota
 	RQSetFavoriteNumber
 	RQListAllUsers
+	RQGetUser
+	RQDeleteUser
+	RQListOnline
 )
 
 //interface for client messages
 type ClientRequest interface {
 	Request() RQEnum
+	ID() string
+	Trace() string
 }
 
 //small struct to indentify message, base "class" for other messages
 //implements ClientRequest interface
 type ClientRQ struct {
 	Cmd RQEnum
+	//optional - when set worker echoes it in reply and acknowledges every request
+	RequestID string `json:",omitempty"`
+	//W3C traceparent of span that sent request - set by weblayer when tracing is on
+	TraceParent string `json:",omitempty"`
 }
 
 func (c ClientRQ) Request() RQEnum {
 	return c.Cmd
 }
 
+func (c ClientRQ) ID() string {
+	return c.RequestID
+}
+
+func (c ClientRQ) Trace() string {
+	return c.TraceParent
+}
+
 /* COMMANDS
 {"Cmd":1,"CmdData":{"UserName":"branko","FavoriteNumber":11}}
 {"Cmd":1,"CmdData":{"UserName":"marko","FavoriteNumber":7}}
@@ -35,6 +52,11 @@ func (c ClientRQ) Request() RQEnum {
 {"Cmd":1,"CmdData":{"UserName":"mihaela","FavoriteNumber":66}}
 
 {"Cmd":2,"CmdData":{"UserName":"ana"}}
+
+{"Cmd":3,"CmdData":{"UserName":"ana"},"RequestID":"1"}
+{"Cmd":4,"CmdData":{"UserName":"ana"},"RequestID":"2"}
+
+{"Cmd":5}
 */
 
 //1. a message to set a user's favorite number
@@ -57,3 +79,47 @@ type ClientGetList struct {
 type GetList struct {
 	UserName string //username as a identifier
 }
+
+//3. a message to get one user and favorite number
+type ClientGetUser struct {
+	ClientRQ
+	CmdData GetUser
+}
+
+type GetUser struct {
+	UserName string
+}
+
+//4. a message to delete user
+type ClientDeleteUser struct {
+	ClientRQ
+	CmdData DeleteUser
+}
+
+type DeleteUser struct {
+	UserName string
+}
+
+//5. a message to list online users
+type ClientListOnline struct {
+	ClientRQ
+}
+
+//////////////////////////////////////////////////////////////////////////
+// messages of weblayer about connection - not client requests
+//////////////////////////////////////////////////////////////////////////
+
+const (
+	//connection opened: "init" or "init {ConnInfo}"
+	InitMessage = "init"
+	//connection closed
+	ClosedMessage = "closed"
+)
+
+//who is on the other side of connection - sent with init
+type ConnInfo struct {
+	//real client IP, resolved through trusted proxies
+	ClientIP string
+	//authenticated user, empty for anonymous
+	User string `json:",omitempty"`
+}
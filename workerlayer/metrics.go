@@ -0,0 +1,28 @@
+package main
+
+import (
+	"runtime"
+	"workerlayer/metrics"
+)
+
+////////////////////////
+// worker metrics
+
+var (
+	messagesIn     = metrics.NewCounter("worker_messages_in_total", "Messages received on conn.*, by command.", "cmd")
+	messagesOut    = metrics.NewCounter("worker_messages_out_total", "Messages published on worker.*, by reply type.", "cmd")
+	publishSeconds = metrics.NewHistogram("worker_redis_publish_seconds", "Latency of PUBLISH to weblayer.", metrics.DefBuckets)
+	getAllSeconds  = metrics.NewHistogram("worker_get_all_users_seconds", "Duration of getAllUsers.", metrics.DefBuckets)
+	pushes         = metrics.NewCounter("worker_pushes_total", "User lists pushed to connections on key change (fan-out).")
+	inflightGauge  = metrics.NewGauge("worker_inflight_messages", "processMessage go routines running.")
+	pushersGauge   = metrics.NewGauge("worker_push_goroutines", "pushKeyChanges go routines running.")
+	resubscribes   = metrics.NewCounter("worker_resubscribes_total", "Subscriptions re-established after connection to redis was lost.", "subscription")
+	_              = metrics.NewGaugeFunc("worker_goroutines", "Go routines in worker process.",
+		func() float64 { return float64(runtime.NumGoroutine()) })
+	_ = metrics.NewGaugeFunc("worker_pscmap_size", "Connections with change notification subscription.",
+		func() float64 {
+			mux.Lock()
+			defer mux.Unlock()
+			return float64(len(watchers))
+		})
+)
@@ -0,0 +1,280 @@
+// metrics package exposes counters, gauges and histograms in prometheus text format
+//
+// small dependency free implementation - enough for /metrics endpoint of both layers
+// metrics are registered in package registry when created, usually as package level vars:
+//
+//	var sent = metrics.NewCounter("weblayer_bytes_sent_total", "Bytes written to websockets.")
+//	sent.Add(float64(len(msg)))
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default latency buckets in seconds
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// metric family that can write itself in text format
+type collector interface {
+	name() string
+	write(b *strings.Builder)
+}
+
+var (
+	regmux     sync.Mutex
+	registered = make(map[string]collector)
+)
+
+func register(c collector) {
+	regmux.Lock()
+	defer regmux.Unlock()
+	if _, exists := registered[c.name()]; exists {
+		panic("metrics: duplicate metric " + c.name())
+	}
+	registered[c.name()] = c
+}
+
+//serves all registered metrics in prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write([]byte(Text()))
+	})
+}
+
+//all registered metrics in prometheus text format, sorted by name
+func Text() string {
+	regmux.Lock()
+	cs := make([]collector, 0, len(registered))
+	for _, c := range registered {
+		cs = append(cs, c)
+	}
+	regmux.Unlock()
+	sort.Slice(cs, func(i, j int) bool { return cs[i].name() < cs[j].name() })
+
+	var b strings.Builder
+	for _, c := range cs {
+		c.write(&b)
+	}
+	return b.String()
+}
+
+//////////////////////////////////////
+// labeled values shared by all types
+
+type family struct {
+	fname  string
+	help   string
+	kind   string
+	labels []string
+
+	mux    sync.Mutex
+	keys   []string
+	values map[string][]string //label values by key
+}
+
+func newFamily(name, help, kind string, labels []string) family {
+	return family{fname: name, help: help, kind: kind, labels: labels, values: make(map[string][]string)}
+}
+
+func (f *family) name() string { return f.fname }
+
+//key of label values - adds label values to family when seen first time
+//caller holds f.mux
+func (f *family) key(lv []string) string {
+	if len(lv) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.fname, len(f.labels), len(lv)))
+	}
+	k := strings.Join(lv, "\xff")
+	if _, exists := f.values[k]; !exists {
+		f.values[k] = append([]string(nil), lv...)
+		f.keys = append(f.keys, k)
+		sort.Strings(f.keys)
+	}
+	return k
+}
+
+func (f *family) header(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n", f.fname, f.help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.fname, f.kind)
+}
+
+//label pairs in {a="x",b="y"} format, extra pair appended (used for le of histogram)
+func (f *family) labelString(lv []string, extraName, extraValue string) string {
+	if len(lv) == 0 && extraName == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(lv)+1)
+	for i, l := range f.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", l, lv[i]))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extraName, extraValue))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+//////////
+// Counter
+
+type Counter struct {
+	family
+	counts map[string]float64
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{family: newFamily(name, help, "counter", labels), counts: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+func (c *Counter) Inc(lv ...string) { c.Add(1, lv...) }
+
+func (c *Counter) Add(v float64, lv ...string) {
+	c.mux.Lock()
+	c.counts[c.key(lv)] += v
+	c.mux.Unlock()
+}
+
+func (c *Counter) write(b *strings.Builder) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.header(b)
+	for _, k := range c.keys {
+		fmt.Fprintf(b, "%s%s %s\n", c.fname, c.labelString(c.values[k], "", ""), formatFloat(c.counts[k]))
+	}
+}
+
+////////
+// Gauge
+
+type Gauge struct {
+	family
+	gauges map[string]float64
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{family: newFamily(name, help, "gauge", labels), gauges: make(map[string]float64)}
+	register(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64, lv ...string) {
+	g.mux.Lock()
+	g.gauges[g.key(lv)] = v
+	g.mux.Unlock()
+}
+
+func (g *Gauge) Add(v float64, lv ...string) {
+	g.mux.Lock()
+	g.gauges[g.key(lv)] += v
+	g.mux.Unlock()
+}
+
+func (g *Gauge) Inc(lv ...string) { g.Add(1, lv...) }
+func (g *Gauge) Dec(lv ...string) { g.Add(-1, lv...) }
+
+func (g *Gauge) write(b *strings.Builder) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	g.header(b)
+	for _, k := range g.keys {
+		fmt.Fprintf(b, "%s%s %s\n", g.fname, g.labelString(g.values[k], "", ""), formatFloat(g.gauges[k]))
+	}
+}
+
+//gauge whose value is read on every scrape
+type GaugeFunc struct {
+	family
+	fn func() float64
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{family: newFamily(name, help, "gauge", nil), fn: fn}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(b *strings.Builder) {
+	g.header(b)
+	fmt.Fprintf(b, "%s %s\n", g.fname, formatFloat(g.fn()))
+}
+
+////////////
+// Histogram
+
+type Histogram struct {
+	family
+	buckets []float64
+	counts  map[string][]uint64 //per bucket, not cumulative
+	sums    map[string]float64
+	totals  map[string]uint64
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		family:  newFamily(name, help, "histogram", labels),
+		buckets: append([]float64(nil), buckets...),
+		counts:  make(map[string][]uint64),
+		sums:    make(map[string]float64),
+		totals:  make(map[string]uint64),
+	}
+	sort.Float64s(h.buckets)
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, lv ...string) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	k := h.key(lv)
+	counts, exists := h.counts[k]
+	if !exists {
+		counts = make([]uint64, len(h.buckets))
+		h.counts[k] = counts
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		counts[i]++
+	}
+	h.sums[k] += v
+	h.totals[k]++
+}
+
+//observe seconds elapsed since start - use in defer
+func (h *Histogram) ObserveSince(start time.Time, lv ...string) {
+	h.Observe(time.Since(start).Seconds(), lv...)
+}
+
+func (h *Histogram) write(b *strings.Builder) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.header(b)
+	for _, k := range h.keys {
+		lv := h.values[k]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += h.counts[k][i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.fname, h.labelString(lv, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.fname, h.labelString(lv, "le", "+Inf"), h.totals[k])
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.fname, h.labelString(lv, "", ""), formatFloat(h.sums[k]))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.fname, h.labelString(lv, "", ""), h.totals[k])
+	}
+}
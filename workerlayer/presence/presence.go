@@ -0,0 +1,174 @@
+// presence package keeps in redis who is online - weblayer writes it, worker reads it
+//
+// all keys have {presence} hash tag, so they are in one slot in cluster mode:
+//
+//	{presence}:conn:{id}    user of connection ("" for anonymous), TTL
+//	{presence}:user:{name}  hash connection id -> unix expiry of its last heartbeat, TTL
+//	{presence}:online       sorted set of users, score is unix expiry of their last heartbeat
+//
+// weblayer refreshes entries of its connections every Heartbeat. entries of crashed instance
+// are not refreshed - keys expire after TTL and Sweep on any other instance removes the user
+// from online set and reports leave
+package presence
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// entries live this long after last heartbeat
+	TTL = 60 * time.Second
+	// period of heartbeat and sweep
+	Heartbeat = 20 * time.Second
+	// channel of join/leave events - every weblayer fans them out to subscribed connections
+	Channel = "presence.events"
+	// session subscription of presence events (?subscribe=presence)
+	Topic = "presence"
+
+	onlineKey = "{presence}:online"
+	// Leave and Sweep give up when user hash keeps changing under WATCH
+	removeRetries = 5
+)
+
+var errRemoveContended = errors.New("presence: user changed during remove, retries exhausted")
+
+//called between check and ZREM of user - tests run Touch here
+var testHookBeforeRemove = func(user string) {}
+
+func connKey(id string) string {
+	return fmt.Sprintf("{presence}:conn:%s", id)
+}
+
+func userKey(user string) string {
+	return fmt.Sprintf("{presence}:user:%s", user)
+}
+
+//create or refresh entries of connection - true when user came online with it
+func Touch(pool *redis.Pool, id, user string) (bool, error) {
+	rc := pool.Get()
+	defer rc.Close()
+
+	ttl := int(TTL.Seconds())
+	if user == "" {
+		_, err := rc.Do("SET", connKey(id), "", "EX", ttl)
+		return false, err
+	}
+	expiry := time.Now().Add(TTL).Unix()
+	rc.Send("MULTI")
+	rc.Send("SET", connKey(id), user, "EX", ttl)
+	rc.Send("HSET", userKey(user), id, expiry)
+	rc.Send("EXPIRE", userKey(user), ttl)
+	rc.Send("ZADD", onlineKey, expiry, user)
+	values, err := redis.Values(rc.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+	added, _ := redis.Int(values[3], nil)
+	return added == 1, nil
+}
+
+//remove entries of closed connection - true when it was last connection of user
+func Leave(pool *redis.Pool, id, user string) (bool, error) {
+	rc := pool.Get()
+	defer rc.Close()
+
+	if user == "" {
+		_, err := rc.Do("DEL", connKey(id))
+		return false, err
+	}
+	rc.Send("MULTI")
+	rc.Send("DEL", connKey(id))
+	rc.Send("HDEL", userKey(user), id)
+	if _, err := rc.Do("EXEC"); err != nil {
+		return false, err
+	}
+	return removeOnline(rc, user, func() (bool, error) {
+		conns, err := redis.Int64Map(rc.Do("HGETALL", userKey(user)))
+		return !live(conns), err
+	})
+}
+
+//ZREM user from online set when gone reports true - check runs under WATCH of user hash,
+//Touch between check and ZREM aborts transaction and check is repeated
+func removeOnline(rc redis.Conn, user string, gone func() (bool, error)) (bool, error) {
+	for i := 0; i < removeRetries; i++ {
+		if _, err := rc.Do("WATCH", userKey(user)); err != nil {
+			return false, err
+		}
+		ok, err := gone()
+		if err != nil || !ok {
+			rc.Do("UNWATCH")
+			return false, err
+		}
+		testHookBeforeRemove(user)
+		rc.Send("MULTI")
+		rc.Send("ZREM", onlineKey, user)
+		values, err := redis.Values(rc.Do("EXEC"))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		removed, _ := redis.Int(values[0], nil)
+		return removed == 1, nil
+	}
+	return false, errRemoveContended
+}
+
+//connections of crashed instance stay in hash until it expires
+func live(conns map[string]int64) bool {
+	now := time.Now().Unix()
+	for _, expiry := range conns {
+		if expiry > now {
+			return true
+		}
+	}
+	return false
+}
+
+//sorted users with live connection
+func Online(pool *redis.Pool) ([]string, error) {
+	rc := pool.Get()
+	defer rc.Close()
+
+	users, err := redis.Strings(rc.Do("ZRANGEBYSCORE", onlineKey, fmt.Sprintf("(%d", time.Now().Unix()), "+inf"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+//remove users whose heartbeats stopped - returns users this call removed,
+//so only one of instances sweeping at the same time reports leave
+func Sweep(pool *redis.Pool) ([]string, error) {
+	rc := pool.Get()
+	defer rc.Close()
+
+	expired, err := redis.Strings(rc.Do("ZRANGEBYSCORE", onlineKey, "-inf", time.Now().Unix()))
+	if err != nil {
+		return nil, err
+	}
+	var gone []string
+	for _, user := range expired {
+		//heartbeat may have come since ZRANGEBYSCORE - score is checked again
+		removed, err := removeOnline(rc, user, func() (bool, error) {
+			expiry, err := redis.Int64(rc.Do("ZSCORE", onlineKey, user))
+			if err == redis.ErrNil {
+				//removed by Leave or other instance
+				return false, nil
+			}
+			return expiry <= time.Now().Unix(), err
+		})
+		if err == nil && removed {
+			gone = append(gone, user)
+		}
+	}
+	return gone, nil
+}
@@ -0,0 +1,126 @@
+package presence
+
+import (
+	"testing"
+	"time"
+	"workerlayer/fakeredis"
+	"workerlayer/redisconn"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func newPool(t *testing.T) *redis.Pool {
+	t.Helper()
+	s, err := fakeredis.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	opts := redisconn.DefaultOptions()
+	opts.URL = s.URL()
+	return redisconn.NewPool(opts)
+}
+
+//run f once between check and ZREM of next remove
+func beforeRemove(t *testing.T, f func()) {
+	t.Helper()
+	done := false
+	testHookBeforeRemove = func(string) {
+		if !done {
+			done = true
+			f()
+		}
+	}
+	t.Cleanup(func() { testHookBeforeRemove = func(string) {} })
+}
+
+func online(t *testing.T, pool *redis.Pool) int {
+	t.Helper()
+	users, err := Online(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(users)
+}
+
+func TestLeaveOfLastConnection(t *testing.T) {
+	pool := newPool(t)
+	if joined, err := Touch(pool, "c1", "ana"); err != nil || !joined {
+		t.Fatal("expected join with first connection:", joined, err)
+	}
+	if joined, _ := Touch(pool, "c2", "ana"); joined {
+		t.Fatal("unexpected join with second connection")
+	}
+	if left, err := Leave(pool, "c1", "ana"); err != nil || left {
+		t.Fatal("unexpected leave while c2 is live:", left, err)
+	}
+	if n := online(t, pool); n != 1 {
+		t.Fatal("expected ana online, got", n, "users")
+	}
+	if left, err := Leave(pool, "c2", "ana"); err != nil || !left {
+		t.Fatal("expected leave with last connection:", left, err)
+	}
+	if n := online(t, pool); n != 0 {
+		t.Fatal("expected nobody online, got", n, "users")
+	}
+}
+
+//new connection of user comes after Leave found no live connection
+func TestLeaveRacingTouch(t *testing.T) {
+	pool := newPool(t)
+	Touch(pool, "c1", "ana")
+	beforeRemove(t, func() {
+		if _, err := Touch(pool, "c2", "ana"); err != nil {
+			t.Error(err)
+		}
+	})
+	if left, err := Leave(pool, "c1", "ana"); err != nil || left {
+		t.Fatal("unexpected leave while c2 is live:", left, err)
+	}
+	if n := online(t, pool); n != 1 {
+		t.Fatal("expected ana online with c2, got", n, "users")
+	}
+}
+
+func TestSweepRemovesExpired(t *testing.T) {
+	pool := newPool(t)
+	Touch(pool, "c1", "ana")
+	Touch(pool, "c2", "bob")
+	expire(t, pool, "ana")
+	gone, err := Sweep(pool)
+	if err != nil || len(gone) != 1 || gone[0] != "ana" {
+		t.Fatal("expected ana swept, got", gone, err)
+	}
+	if n := online(t, pool); n != 1 {
+		t.Fatal("expected bob online, got", n, "users")
+	}
+}
+
+//heartbeat comes after Sweep read expired users
+func TestSweepRacingTouch(t *testing.T) {
+	pool := newPool(t)
+	Touch(pool, "c1", "ana")
+	expire(t, pool, "ana")
+	beforeRemove(t, func() {
+		if _, err := Touch(pool, "c1", "ana"); err != nil {
+			t.Error(err)
+		}
+	})
+	gone, err := Sweep(pool)
+	if err != nil || len(gone) != 0 {
+		t.Fatal("unexpected sweep of refreshed user:", gone, err)
+	}
+	if n := online(t, pool); n != 1 {
+		t.Fatal("expected ana online after heartbeat, got", n, "users")
+	}
+}
+
+//score of user as if its heartbeats stopped
+func expire(t *testing.T, pool *redis.Pool, user string) {
+	t.Helper()
+	rc := pool.Get()
+	defer rc.Close()
+	if _, err := rc.Do("ZADD", onlineKey, time.Now().Add(-time.Second).Unix(), user); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,359 @@
+package redisconn
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"workerlayer/metrics"
+	"workerlayer/utl"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//////////////////////////////////////////////////////
+// cluster - minimal Redis Cluster client over redigo
+//
+// connection from cluster pool is bound to one node on its first command with a key:
+// node is owner of key's slot in slot map (CLUSTER SLOTS). commands without key bind to any node -
+// pub/sub works on every node, PUBLISH is propagated to whole cluster. MULTI is held back
+// until first key in transaction, so whole transaction goes to the node of that key -
+// keys of one transaction must share hash tag, e.g. {users}:seq and {users}:index.
+// single command that gets MOVED/ASK is redirected once and slot map is refreshed.
+
+const (
+	// slots of redis cluster
+	clusterSlots = 16384
+	// period of slot map refresh
+	slotsRefresh = 30 * time.Second
+	// slot map is not refreshed more often than this on MOVED
+	slotsMinRefresh = time.Second
+)
+
+var redirects = metrics.NewCounter("redis_cluster_redirects_total", "MOVED/ASK replies of redis cluster.", "kind")
+
+type Cluster struct {
+	//host:port of nodes to load slot map from - cluster mode when set
+	Addrs []string `yaml:"addrs" env:"REDIS_CLUSTER_ADDRS" flag:"--redis-cluster"`
+}
+
+type cluster struct {
+	opts Options
+
+	mux         sync.Mutex
+	slots       [clusterSlots]string
+	nodes       map[string]*redis.Pool
+	lastRefresh time.Time
+}
+
+//keyless commands - everything else has key as first argument
+var keyless = map[string]bool{
+	"": true, "PING": true, "ECHO": true, "AUTH": true, "SELECT": true, "ROLE": true, "INFO": true, "CLUSTER": true,
+	"ASKING": true, "QUIT": true, "MULTI": true, "EXEC": true, "DISCARD": true, "PUBLISH": true,
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "UNSUBSCRIBE": true, "PUNSUBSCRIBE": true,
+}
+
+func newCluster(o Options) *cluster {
+	cl := &cluster{opts: o, nodes: make(map[string]*redis.Pool)}
+	if err := cl.refresh(); err != nil {
+		utl.ERR("redis cluster", "slots", err)
+	}
+	go func() {
+		for range time.Tick(slotsRefresh) {
+			if err := cl.refresh(); err != nil {
+				utl.ERR("redis cluster", "slots", err)
+			}
+		}
+	}()
+	return cl
+}
+
+//slot of key - only part in {} is hashed when key has hash tag
+func Slot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+//CRC16-CCITT (XMODEM) used by redis cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for b := 0; b < 8; b++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+//load slot map from first node that answers CLUSTER SLOTS
+func (cl *cluster) refresh() error {
+	cl.mux.Lock()
+	cl.lastRefresh = time.Now()
+	addrs := append([]string{}, cl.opts.Cluster.Addrs...)
+	for addr := range cl.nodes {
+		addrs = append(addrs, addr)
+	}
+	cl.mux.Unlock()
+
+	var lastErr error
+	for _, addr := range addrs {
+		ranges, err := cl.clusterSlots(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		cl.mux.Lock()
+		for _, r := range ranges {
+			for slot := r.start; slot <= r.end && slot < clusterSlots; slot++ {
+				cl.slots[slot] = r.addr
+			}
+		}
+		cl.mux.Unlock()
+		return nil
+	}
+	return fmt.Errorf("no node answered CLUSTER SLOTS: %v", lastErr)
+}
+
+type slotRange struct {
+	start, end int
+	addr       string
+}
+
+func (cl *cluster) clusterSlots(addr string) ([]slotRange, error) {
+	c := cl.node(addr).Get()
+	defer c.Close()
+	values, err := redis.Values(c.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+	var ranges []slotRange
+	for _, v := range values {
+		//start, end, [ip, port, id], replicas...
+		r, err := redis.Values(v, nil)
+		if err != nil || len(r) < 3 {
+			return nil, fmt.Errorf("unexpected CLUSTER SLOTS reply from %s", addr)
+		}
+		master, err := redis.Values(r[2], nil)
+		if err != nil || len(master) < 2 {
+			return nil, fmt.Errorf("unexpected CLUSTER SLOTS reply from %s", addr)
+		}
+		start, _ := redis.Int(r[0], nil)
+		end, _ := redis.Int(r[1], nil)
+		host, _ := redis.String(master[0], nil)
+		port, _ := redis.Int(master[1], nil)
+		if host == "" {
+			//node does not know own address - same as the one we asked
+			host, _, _ = net.SplitHostPort(addr)
+		}
+		ranges = append(ranges, slotRange{start: start, end: end, addr: net.JoinHostPort(host, strconv.Itoa(port))})
+	}
+	return ranges, nil
+}
+
+//refresh after redirect - at most once per slotsMinRefresh
+func (cl *cluster) refreshSoon() {
+	cl.mux.Lock()
+	recent := time.Since(cl.lastRefresh) < slotsMinRefresh
+	cl.mux.Unlock()
+	if !recent {
+		go cl.refresh()
+	}
+}
+
+//pool of node at addr
+func (cl *cluster) node(addr string) *redis.Pool {
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+	p, exists := cl.nodes[addr]
+	if !exists {
+		p = newNodePool(cl.opts, func() (redis.Conn, error) { return cl.opts.dialAddr(addr, nil) })
+		cl.nodes[addr] = p
+	}
+	return p
+}
+
+//address of node for key, any node for keyless command
+func (cl *cluster) addr(key string, hasKey bool) (string, error) {
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+	if hasKey {
+		if addr := cl.slots[Slot(key)]; addr != "" {
+			return addr, nil
+		}
+	}
+	var addrs []string
+	for addr := range cl.nodes {
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		addrs = cl.opts.Cluster.Addrs
+	}
+	if len(addrs) == 0 {
+		return "", errors.New("no redis cluster nodes")
+	}
+	return addrs[rand.Intn(len(addrs))], nil
+}
+
+//unbound connection - pool of cluster creates these without network round trip
+func (cl *cluster) dial() (redis.Conn, error) {
+	return &clusterConn{cl: cl}, nil
+}
+
+//redis.Conn bound to node on first command
+type clusterConn struct {
+	cl   *cluster
+	conn redis.Conn
+	//commands sent before bind (MULTI)
+	held [][]interface{}
+	//Send was used - replies of pipeline are not redirected
+	sent bool
+}
+
+//first key of command, false for keyless commands
+func commandKey(cmd string, args []interface{}) (string, bool) {
+	if keyless[strings.ToUpper(cmd)] || len(args) == 0 {
+		return "", false
+	}
+	switch k := args[0].(type) {
+	case string:
+		return k, true
+	case []byte:
+		return string(k), true
+	}
+	return fmt.Sprint(args[0]), true
+}
+
+func (c *clusterConn) bind(cmd string, args []interface{}) error {
+	if c.conn != nil {
+		return nil
+	}
+	key, hasKey := commandKey(cmd, args)
+	addr, err := c.cl.addr(key, hasKey)
+	if err != nil {
+		return err
+	}
+	c.conn = c.cl.node(addr).Get()
+	for _, h := range c.held {
+		if err := c.conn.Send(h[0].(string), h[1:]...); err != nil {
+			return err
+		}
+	}
+	c.held = nil
+	return nil
+}
+
+func (c *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if c.conn == nil && cmd == "" {
+		return nil, nil
+	}
+	if err := c.bind(cmd, args); err != nil {
+		return nil, err
+	}
+	redirectable := !c.sent
+	reply, err := c.conn.Do(cmd, args...)
+	if re, ok := err.(redis.Error); ok && redirectable {
+		return c.redirect(re, reply, cmd, args)
+	}
+	return reply, err
+}
+
+//follow MOVED/ASK of single command once
+func (c *clusterConn) redirect(re redis.Error, reply interface{}, cmd string, args []interface{}) (interface{}, error) {
+	parts := strings.Fields(string(re))
+	if len(parts) != 3 || (parts[0] != "MOVED" && parts[0] != "ASK") {
+		return reply, re
+	}
+	redirects.Inc(strings.ToLower(parts[0]))
+	c.cl.refreshSoon()
+	addr := parts[2]
+
+	if parts[0] == "MOVED" {
+		//slot has new owner - rebind connection
+		slot, _ := strconv.Atoi(parts[1])
+		c.cl.mux.Lock()
+		if slot >= 0 && slot < clusterSlots {
+			c.cl.slots[slot] = addr
+		}
+		c.cl.mux.Unlock()
+		c.conn.Close()
+		c.conn = c.cl.node(addr).Get()
+		return c.conn.Do(cmd, args...)
+	}
+
+	//ASK - only this command goes to other node, slot is migrating
+	ask := c.cl.node(addr).Get()
+	defer ask.Close()
+	if _, err := ask.Do("ASKING"); err != nil {
+		return nil, err
+	}
+	return ask.Do(cmd, args...)
+}
+
+func (c *clusterConn) Send(cmd string, args ...interface{}) error {
+	c.sent = true
+	if c.conn == nil && strings.ToUpper(cmd) == "MULTI" {
+		//transaction goes to node of first key in it
+		c.held = append(c.held, append([]interface{}{cmd}, args...))
+		return nil
+	}
+	if err := c.bind(cmd, args); err != nil {
+		return err
+	}
+	return c.conn.Send(cmd, args...)
+}
+
+func (c *clusterConn) Flush() error {
+	if err := c.bind("", nil); err != nil {
+		return err
+	}
+	return c.conn.Flush()
+}
+
+func (c *clusterConn) Receive() (interface{}, error) {
+	if err := c.bind("", nil); err != nil {
+		return nil, err
+	}
+	return c.conn.Receive()
+}
+
+func (c *clusterConn) Err() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Err()
+}
+
+func (c *clusterConn) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+//cluster mode options - s is resolved server options
+func (cl Cluster) validate(s server) error {
+	for _, addr := range cl.Addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("cluster node %q: %v", addr, err)
+		}
+	}
+	if s.db != 0 {
+		return errors.New("redis cluster has only database 0")
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package redisconn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"workerlayer/metrics"
+	"workerlayer/utl"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//////////////////////////////////////////////////////
+// sentinel - primary is discovered through Redis Sentinel
+//
+// every dial asks sentinels for current primary of master name and checks ROLE of server.
+// watcher go routine is subscribed on +switch-master of sentinel; on failover all connections
+// to old primary are closed. pool drops them and pub/sub loops (router, conn.*, keyspace)
+// get receive error, re-dial new primary and subscribe again.
+
+const (
+	// delay before watcher tries next sentinel
+	sentinelRetry = time.Second
+	// period of primary check by watcher - in case +switch-master was missed
+	sentinelCheck = 10 * time.Second
+)
+
+var failovers = metrics.NewCounter("redis_failovers_total", "Primary changes seen through sentinel.")
+
+type Sentinel struct {
+	//name of monitored master - sentinel mode when set, url/host/port are ignored
+	Master string `yaml:"master" env:"REDIS_SENTINEL_MASTER" flag:"--redis-sentinel-master"`
+	//host:port of sentinels
+	Addrs    []string `yaml:"addrs" env:"REDIS_SENTINEL_ADDRS" flag:"--redis-sentinel"`
+	Password string   `yaml:"password" env:"REDIS_SENTINEL_PASSWORD" secret:"true"`
+}
+
+type sentinel struct {
+	opts Options
+
+	mux sync.Mutex
+	//primary connections are dialed to - "" until first dial
+	primary string
+	conns   map[*trackedConn]bool
+}
+
+//net.Conn to primary that is closed on failover
+type trackedConn struct {
+	net.Conn
+	st *sentinel
+
+	mux    sync.Mutex
+	closed bool
+}
+
+func (c *trackedConn) Close() error {
+	c.mux.Lock()
+	c.closed = true
+	c.mux.Unlock()
+
+	c.st.mux.Lock()
+	delete(c.st.conns, c)
+	c.st.mux.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *trackedConn) isClosed() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.closed
+}
+
+//redis.Conn with its tracked net.Conn - TestOnBorrow rejects closed ones
+type sentinelConn struct {
+	redis.Conn
+	nc *trackedConn
+}
+
+func newSentinel(o Options) *sentinel {
+	return &sentinel{opts: o, conns: make(map[*trackedConn]bool)}
+}
+
+//ask sentinels for address of primary - first one that answers wins
+func (st *sentinel) discover() (string, error) {
+	var lastErr error
+	for _, addr := range st.opts.Sentinel.Addrs {
+		addr, err := st.ask(addr)
+		if err == nil {
+			return addr, nil
+		}
+		lastErr = err
+	}
+	return "", fmt.Errorf("no sentinel knows primary %q: %v", st.opts.Sentinel.Master, lastErr)
+}
+
+func (st *sentinel) ask(sentinelAddr string) (string, error) {
+	c, err := st.dialSentinel(sentinelAddr)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	hostport, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", st.opts.Sentinel.Master))
+	if err != nil {
+		return "", err
+	}
+	if len(hostport) != 2 {
+		return "", fmt.Errorf("sentinel %s: unexpected reply %v", sentinelAddr, hostport)
+	}
+	return net.JoinHostPort(hostport[0], hostport[1]), nil
+}
+
+func (st *sentinel) dialSentinel(addr string) (redis.Conn, error) {
+	return redis.Dial("tcp", addr,
+		redis.DialConnectTimeout(st.opts.ConnectTimeout),
+		redis.DialPassword(st.opts.Sentinel.Password))
+}
+
+//dial current primary
+func (st *sentinel) dial() (redis.Conn, error) {
+	addr, err := st.discover()
+	if err != nil {
+		return nil, err
+	}
+	st.switchTo(addr)
+
+	var nc *trackedConn
+	netDial := func(network, address string) (net.Conn, error) {
+		c, err := net.DialTimeout(network, address, st.opts.ConnectTimeout)
+		if err != nil {
+			return nil, err
+		}
+		nc = &trackedConn{Conn: c, st: st}
+		st.mux.Lock()
+		st.conns[nc] = true
+		st.mux.Unlock()
+		return nc, nil
+	}
+	c, err := st.opts.dialAddr(addr, netDial)
+	if err != nil {
+		return nil, err
+	}
+
+	//sentinel may answer with old primary during failover
+	role, err := redis.Values(c.Do("ROLE"))
+	if err == nil && len(role) > 0 {
+		if r, _ := redis.String(role[0], nil); r != "master" {
+			err = fmt.Errorf("%s is %s, not master", addr, r)
+		}
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return sentinelConn{Conn: c, nc: nc}, nil
+}
+
+//remember primary - connections to previous one are closed
+func (st *sentinel) switchTo(addr string) {
+	st.mux.Lock()
+	old := st.primary
+	st.primary = addr
+	var stale []*trackedConn
+	if old != "" && old != addr {
+		for c := range st.conns {
+			stale = append(stale, c)
+		}
+	}
+	st.mux.Unlock()
+
+	if len(stale) == 0 {
+		return
+	}
+	failovers.Inc()
+	utl.WARN("redis", "failover", old, "->", addr, "closing", len(stale), "connections")
+	for _, c := range stale {
+		c.Close()
+	}
+}
+
+//follow +switch-master events for lifetime of process
+func (st *sentinel) watch() {
+	for i := 0; ; i++ {
+		addr := st.opts.Sentinel.Addrs[i%len(st.opts.Sentinel.Addrs)]
+		if err := st.watchOne(addr); err != nil {
+			utl.WARN("redis", "sentinel", addr, err)
+		}
+		time.Sleep(sentinelRetry)
+	}
+}
+
+func (st *sentinel) watchOne(addr string) error {
+	c, err := st.dialSentinel(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	psc := redis.PubSubConn{Conn: c}
+	if err := psc.Subscribe("+switch-master"); err != nil {
+		return err
+	}
+
+	//periodic check of primary - pings keep subscription alive too
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(sentinelCheck)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if primary, err := st.ask(addr); err == nil {
+					st.switchTo(primary)
+				}
+				psc.Ping("")
+			}
+		}
+	}()
+
+	for {
+		switch n := psc.Receive().(type) {
+		case error:
+			return n
+		case redis.Message:
+			//"<master name> <old ip> <old port> <new ip> <new port>"
+			parts := strings.Fields(string(n.Data))
+			if len(parts) == 5 && parts[0] == st.opts.Sentinel.Master {
+				st.switchTo(net.JoinHostPort(parts[3], parts[4]))
+			}
+		}
+	}
+}
+
+//sentinel mode options
+func (s Sentinel) validate() error {
+	if len(s.Addrs) == 0 {
+		return errors.New("sentinel addrs are required with sentinel master")
+	}
+	for _, addr := range s.Addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("sentinel %q: %v", addr, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+	"workerlayer/utl"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// time allowed for in flight messages to finish on shutdown
+const shutdownWait = 10 * time.Second
+
+//subscription on conn.* - unsubscribed on shutdown
+var connpsc *redis.PubSubConn
+
+// waits for SIGINT/SIGTERM and stops consuming conn.* messages
+// readConnMessages returns when unsubscribe is confirmed
+func handleSignals() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sig
+	utl.INFO("worker", "got signal", s, "- shutting down")
+	setShuttingDown()
+
+	//under mux - pinger writes to the same connection
+	mux.Lock()
+	defer mux.Unlock()
+	if connpsc == nil {
+		//reconnecting - readConnMessages and consumeConnMessages see shutdown and return
+		return
+	}
+	if err := connpsc.PUnsubscribe("conn.*"); err != nil {
+		utl.ERR("worker", "punsubscribe conn.*", err)
+		os.Exit(1)
+	}
+}
+
+// wait for in flight processMessage calls, then stop all pushKeyChanges go routines
+func drain(timeout time.Duration) {
+	deadline := time.After(timeout)
+
+	if !wait(&inflight, deadline) {
+		utl.WARN("drain", "timeout waiting for in flight messages")
+		return
+	}
+
+	mux.Lock()
+	for id, w := range watchers {
+		w.Close()
+		delete(watchers, id)
+	}
+	mux.Unlock()
+
+	if !wait(&pushers, deadline) {
+		utl.WARN("drain", "timeout waiting for pushKeyChanges go routines")
+		return
+	}
+	utl.INFO("worker stopped")
+}
+
+//wait on WaitGroup until deadline - false if deadline expired
+func wait(wg *sync.WaitGroup, deadline <-chan time.Time) bool {
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-deadline:
+		return false
+	}
+}
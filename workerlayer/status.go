@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+	"workerlayer/health"
+	"workerlayer/metrics"
+	"workerlayer/utl"
+)
+
+///////////////////////////////////////////
+// http server for health/readiness checks
+
+const (
+	// period of pings on conn.* subscription
+	pingPeriod = 5 * time.Second
+	// subscription is unhealthy when there was no pong for this long
+	pongTimeout = 3 * pingPeriod
+)
+
+var (
+	statusmux sync.Mutex
+	lastPong  time.Time
+	stopping  bool
+)
+
+func startStatusServer(port string) {
+	checker := health.New()
+	checker.Add("redis", health.RedisPing(Pool))
+	checker.Add("subscription", subscriptionHealthy)
+	checker.Add("shutdown", health.NotShuttingDown(shuttingDown))
+
+	mux := http.NewServeMux()
+	checker.Register(mux)
+	mux.Handle("/metrics", metrics.Handler())
+
+	utl.INFO("worker status http on port", port)
+	err := http.ListenAndServe(fmt.Sprintf("0.0.0.0:%v", port), mux)
+	if err != nil {
+		utl.ERR("status ListenAndServe", err)
+	}
+}
+
+//record pong (or subscribe confirmation) on conn.* subscription
+func pong() {
+	statusmux.Lock()
+	lastPong = time.Now()
+	statusmux.Unlock()
+}
+
+func subscriptionHealthy() error {
+	statusmux.Lock()
+	defer statusmux.Unlock()
+	if since := time.Since(lastPong); since > pongTimeout {
+		return fmt.Errorf("no pong on conn.* subscription for %v", since.Truncate(time.Second))
+	}
+	return nil
+}
+
+func setShuttingDown() {
+	statusmux.Lock()
+	stopping = true
+	statusmux.Unlock()
+}
+
+func shuttingDown() bool {
+	statusmux.Lock()
+	defer statusmux.Unlock()
+	return stopping
+}
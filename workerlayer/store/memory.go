@@ -0,0 +1,109 @@
+package store
+
+import (
+	"sync"
+	"time"
+	"workerlayer/messages"
+)
+
+//changes buffered for slow watcher - more are dropped, next push has whole list anyway
+const memoryWatchBuffer = 64
+
+//users in worker process - for single worker and tests
+type Memory struct {
+	mux      sync.Mutex
+	favnums  map[string]int
+	seq      int64
+	watchers map[*memoryWatcher]bool
+}
+
+//seq starts at start time in microseconds - sessions and SSE clients keep seq of previous run,
+//so it must not start again from 0 after restart (stays below 2^53 for JavaScript clients)
+func NewMemory() *Memory {
+	return &Memory{favnums: make(map[string]int), seq: time.Now().UnixMicro(), watchers: make(map[*memoryWatcher]bool)}
+}
+
+func (m *Memory) Set(user messages.User, tp string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.favnums[user.Username] = user.Favnum
+	m.changed(Change{User: user.Username, TraceParent: tp})
+	return nil
+}
+
+func (m *Memory) Get(name string) (messages.User, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	favnum, exists := m.favnums[name]
+	if !exists {
+		return messages.User{}, ErrNotFound
+	}
+	return messages.User{Username: name, Favnum: favnum}, nil
+}
+
+func (m *Memory) Delete(name string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, exists := m.favnums[name]; !exists {
+		return ErrNotFound
+	}
+	delete(m.favnums, name)
+	m.changed(Change{User: name})
+	return nil
+}
+
+func (m *Memory) List(q Query) (List, error) {
+	m.mux.Lock()
+	users := make([]messages.User, 0, len(m.favnums))
+	for name, favnum := range m.favnums {
+		users = append(users, messages.User{Username: name, Favnum: favnum})
+	}
+	list := List{Seq: m.seq, Total: len(users)}
+	m.mux.Unlock()
+
+	list.Users = page(users, q)
+	return list, nil
+}
+
+func (m *Memory) Watch() (Watcher, error) {
+	w := &memoryWatcher{m: m, changes: make(chan Change, memoryWatchBuffer)}
+	m.mux.Lock()
+	m.watchers[w] = true
+	m.mux.Unlock()
+	return w, nil
+}
+
+//new version of list - called under mux
+func (m *Memory) changed(c Change) {
+	m.seq++
+	for w := range m.watchers {
+		select {
+		case w.changes <- c:
+		default:
+		}
+	}
+}
+
+type memoryWatcher struct {
+	m       *Memory
+	changes chan Change
+}
+
+func (w *memoryWatcher) Changes() <-chan Change {
+	return w.changes
+}
+
+//memory watch is never lost
+func (w *memoryWatcher) Err() error {
+	return nil
+}
+
+func (w *memoryWatcher) Close() error {
+	w.m.mux.Lock()
+	defer w.m.mux.Unlock()
+	if w.m.watchers[w] {
+		delete(w.m.watchers, w)
+		close(w.changes)
+	}
+	return nil
+}
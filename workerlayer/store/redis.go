@@ -0,0 +1,423 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"workerlayer/messages"
+	"workerlayer/trace"
+	"workerlayer/utl"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//////////////////////////////////////////////////////
+// key and channel layout of user data
+//
+// single node (default):
+//	user:{name}   hash username, favnum
+//	users         set of usernames - sorted with SORT ... BY user:*->username
+//	users:seq     version of user list
+//	changes are keyspace notifications of user:* (notify-keyspace-events)
+//	with tracing on, user:{name} also has field trace - traceparent of last write
+//
+// cluster mode - all keys have {users} hash tag, so they are in one slot and in one transaction:
+//	{users}:favnum   hash username -> favnum
+//	{users}:index    sorted set of usernames with score 0 - ZRANGEBYLEX returns them sorted
+//	{users}:seq      version of user list
+//	keyspace notifications are local to node, so writer publishes users.changed
+//	in the same transaction - PUBLISH reaches subscribers on every node
+//	payload is "{name}" or "{name} {traceparent}" with tracing on
+
+const (
+	usersKey   = "users"
+	seqKey     = "users:seq"
+	userPrefix = "user:"
+
+	clusterFavnumKey = "{users}:favnum"
+	clusterIndexKey  = "{users}:index"
+	clusterSeqKey    = "{users}:seq"
+	// channel of change notifications in cluster mode
+	changesChannel = "users.changed"
+	// pattern of change notifications on single node
+	keyspacePattern = "*keyspace*:user:*"
+	// field of user hash with traceparent of last write
+	traceField = "trace"
+	// Delete gives up when user keeps changing under WATCH
+	deleteRetries = 5
+)
+
+var errDeleteContended = errors.New("user changed during delete, retries exhausted")
+
+//users in redis - shared by all workers
+type Redis struct {
+	pool *redis.Pool
+	//cluster layout - set when pool is for Redis Cluster
+	cluster bool
+}
+
+func NewRedis(pool *redis.Pool, cluster bool) *Redis {
+	return &Redis{pool: pool, cluster: cluster}
+}
+
+func userKey(name string) string {
+	return userPrefix + name
+}
+
+func (s *Redis) Set(user messages.User, tp string) error {
+	if s.cluster {
+		return s.clusterSet(user, tp)
+	}
+	rc := s.pool.Get()
+	defer rc.Close()
+
+	//in transaction - keyspace event is received after seq is incremented
+	rc.Send("MULTI")
+	rc.Send("INCR", seqKey)
+	if tp != "" {
+		rc.Send("HMSET", userKey(user.Username), "username", user.Username, "favnum", user.Favnum, traceField, tp)
+	} else {
+		rc.Send("HMSET", userKey(user.Username), "username", user.Username, "favnum", user.Favnum)
+	}
+	rc.Send("SADD", usersKey, user.Username)
+	_, err := rc.Do("EXEC")
+	return err
+}
+
+func (s *Redis) Get(name string) (messages.User, error) {
+	if s.cluster {
+		return s.clusterGet(name)
+	}
+	rc := s.pool.Get()
+	defer rc.Close()
+
+	var user messages.User
+	values, err := redis.Values(rc.Do("HMGET", userKey(name), "username", "favnum"))
+	if err != nil {
+		utl.ERR("getUser", err)
+		return user, err
+	}
+	if values[0] == nil {
+		return user, ErrNotFound
+	}
+	if _, err := redis.Scan(values, &user.Username, &user.Favnum); err != nil {
+		utl.ERR("getUser scan", err)
+		return user, err
+	}
+	return user, nil
+}
+
+//delete user hash and remove from users set - keyspace event notifies watchers
+func (s *Redis) Delete(name string) error {
+	if s.cluster {
+		return s.clusterDelete(name)
+	}
+	rc := s.pool.Get()
+	defer rc.Close()
+
+	err := deleteIfExists(rc, userKey(name), func() (bool, error) {
+		return redis.Bool(rc.Do("EXISTS", userKey(name)))
+	}, func() {
+		rc.Send("DEL", userKey(name))
+		rc.Send("SREM", usersKey, name)
+		rc.Send("INCR", seqKey)
+	})
+	if err != nil && err != ErrNotFound {
+		utl.ERR("deleteUser", err)
+	}
+	return err
+}
+
+//run delete transaction only when user exists, so seq is not incremented by no-op delete -
+//existence is checked under WATCH of key, change of key before EXEC aborts transaction and check is repeated
+func deleteIfExists(rc redis.Conn, key string, exists func() (bool, error), tx func()) error {
+	for i := 0; i < deleteRetries; i++ {
+		if _, err := rc.Do("WATCH", key); err != nil {
+			return err
+		}
+		ok, err := exists()
+		if err != nil || !ok {
+			rc.Do("UNWATCH")
+			if err == nil {
+				err = ErrNotFound
+			}
+			return err
+		}
+		rc.Send("MULTI")
+		tx()
+		if _, err := redis.Values(rc.Do("EXEC")); err != redis.ErrNil {
+			return err
+		}
+	}
+	return errDeleteContended
+}
+
+//sorted page by SORT and version of list - read in transaction so they match
+func (s *Redis) List(q Query) (List, error) {
+	if s.cluster {
+		return s.clusterList(q)
+	}
+	rc := s.pool.Get()
+	defer rc.Close()
+
+	args := []interface{}{usersKey}
+	if q.SortBy == SortByFavnum {
+		args = append(args, "BY", "user:*->favnum")
+	} else {
+		args = append(args, "ALPHA", "BY", "user:*->username")
+	}
+	if q.Desc {
+		args = append(args, "DESC")
+	}
+	if q.Offset > 0 || q.Limit > 0 {
+		//negative count - all elements from offset
+		offset, count := q.Offset, q.Limit
+		if offset < 0 {
+			offset = 0
+		}
+		if count <= 0 {
+			count = -1
+		}
+		args = append(args, "LIMIT", offset, count)
+	}
+	args = append(args, "GET", "user:*->username", "GET", "user:*->favnum")
+
+	var list List
+	rc.Send("MULTI")
+	rc.Send("GET", seqKey)
+	rc.Send("SCARD", usersKey)
+	rc.Send("SORT", args...)
+	result, err := redis.Values(rc.Do("EXEC"))
+	if err == nil && len(result) != 3 {
+		err = errors.New("unexpected EXEC reply")
+	}
+	if err != nil {
+		return list, err
+	}
+	//seq is nil until first change
+	list.Seq, _ = redis.Int64(result[0], nil)
+	list.Total, _ = redis.Int(result[1], nil)
+	values, err := redis.Values(result[2], nil)
+	if err != nil {
+		return list, err
+	}
+	if err := redis.ScanSlice(values, &list.Users); err != nil {
+		return list, fmt.Errorf("scan users: %v", err)
+	}
+	return list, nil
+}
+
+//tp is traceparent of write, "" when tracing is off
+func (s *Redis) clusterSet(user messages.User, tp string) error {
+	rc := s.pool.Get()
+	defer rc.Close()
+
+	change := user.Username
+	if tp != "" {
+		change += " " + tp
+	}
+	rc.Send("MULTI")
+	rc.Send("INCR", clusterSeqKey)
+	rc.Send("HSET", clusterFavnumKey, user.Username, user.Favnum)
+	rc.Send("ZADD", clusterIndexKey, 0, user.Username)
+	rc.Send("PUBLISH", changesChannel, change)
+	_, err := rc.Do("EXEC")
+	return err
+}
+
+func (s *Redis) clusterGet(name string) (messages.User, error) {
+	rc := s.pool.Get()
+	defer rc.Close()
+
+	user := messages.User{Username: name}
+	favnum, err := redis.Int(rc.Do("HGET", clusterFavnumKey, name))
+	if err == redis.ErrNil {
+		return user, ErrNotFound
+	}
+	if err != nil {
+		utl.ERR("getUser", err)
+		return user, err
+	}
+	user.Favnum = favnum
+	return user, nil
+}
+
+func (s *Redis) clusterDelete(name string) error {
+	rc := s.pool.Get()
+	defer rc.Close()
+
+	err := deleteIfExists(rc, clusterFavnumKey, func() (bool, error) {
+		favnum, err := rc.Do("HGET", clusterFavnumKey, name)
+		return favnum != nil, err
+	}, func() {
+		rc.Send("HDEL", clusterFavnumKey, name)
+		rc.Send("ZREM", clusterIndexKey, name)
+		rc.Send("INCR", clusterSeqKey)
+		rc.Send("PUBLISH", changesChannel, name)
+	})
+	if err != nil && err != ErrNotFound {
+		utl.ERR("deleteUser", err)
+	}
+	return err
+}
+
+//users from lex index and favnums in one transaction with seq - sorted and paged here, SORT BY is not allowed in cluster
+func (s *Redis) clusterList(q Query) (List, error) {
+	rc := s.pool.Get()
+	defer rc.Close()
+
+	var list List
+	rc.Send("MULTI")
+	rc.Send("GET", clusterSeqKey)
+	rc.Send("ZRANGEBYLEX", clusterIndexKey, "-", "+")
+	rc.Send("HGETALL", clusterFavnumKey)
+	result, err := redis.Values(rc.Do("EXEC"))
+	if err == nil && len(result) != 3 {
+		err = errors.New("unexpected EXEC reply")
+	}
+	if err != nil {
+		return list, err
+	}
+	//seq is nil until first change
+	list.Seq, _ = redis.Int64(result[0], nil)
+	names, err := redis.Strings(result[1], nil)
+	if err != nil {
+		return list, err
+	}
+	favnums, err := redis.IntMap(result[2], nil)
+	if err != nil {
+		return list, err
+	}
+	users := make([]messages.User, 0, len(names))
+	for _, name := range names {
+		users = append(users, messages.User{Username: name, Favnum: favnums[name]})
+	}
+	list.Total = len(users)
+	list.Users = page(users, q)
+	return list, nil
+}
+
+//subscribe on change notifications of layout and wait for confirmation
+func (s *Redis) Watch() (Watcher, error) {
+	rc := s.pool.Get()
+	psc := redis.PubSubConn{Conn: rc}
+	var err error
+	if s.cluster {
+		err = psc.Subscribe(changesChannel)
+	} else {
+		err = psc.PSubscribe(keyspacePattern)
+	}
+	if err == nil {
+		switch n := psc.Receive().(type) {
+		case error:
+			err = n
+		case redis.Subscription:
+		default:
+			err = fmt.Errorf("unexpected reply %T to subscribe", n)
+		}
+	}
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	w := &redisWatcher{s: s, psc: psc, changes: make(chan Change)}
+	go w.receive()
+	return w, nil
+}
+
+//subscription on own connection - reader of Changes must read until it is closed
+type redisWatcher struct {
+	s       *Redis
+	psc     redis.PubSubConn
+	changes chan Change
+
+	//Close and end of receive loop both write to connection
+	mux    sync.Mutex
+	closed bool
+	ended  bool
+	err    error
+}
+
+func (w *redisWatcher) Changes() <-chan Change {
+	return w.changes
+}
+
+func (w *redisWatcher) Err() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return w.err
+}
+
+//unsubscribe - receive loop ends on confirmation
+func (w *redisWatcher) Close() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.closed || w.ended {
+		w.closed = true
+		return nil
+	}
+	w.closed = true
+	if w.s.cluster {
+		return w.psc.Unsubscribe(changesChannel)
+	}
+	return w.psc.PUnsubscribe(keyspacePattern)
+}
+
+func (w *redisWatcher) receive() {
+	defer close(w.changes)
+	for {
+		switch n := w.psc.Receive().(type) {
+		case error:
+			w.end(n)
+			return
+		case redis.Subscription:
+			if n.Kind == "punsubscribe" || n.Kind == "unsubscribe" {
+				w.end(nil)
+				return
+			}
+		case redis.Message:
+			//users.changed in cluster mode - "{name}" or "{name} {traceparent}"
+			fields := strings.Fields(string(n.Data))
+			c := Change{}
+			if len(fields) > 0 {
+				c.User = fields[0]
+			}
+			if len(fields) == 2 {
+				c.TraceParent = fields[1]
+			}
+			w.changes <- c
+		case redis.PMessage:
+			//keyspace notification on single node - channel is __keyspace@{db}__:user:{name}
+			w.changes <- w.s.keyspaceChange(n.Channel)
+		}
+	}
+}
+
+//return connection to pool - error is kept only when watch was lost
+func (w *redisWatcher) end(err error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.closed {
+		err = nil
+	}
+	w.err = err
+	w.ended = true
+	w.psc.Conn.Close()
+}
+
+//user of keyspace channel and traceparent of its last write when tracing is on
+func (s *Redis) keyspaceChange(channel string) Change {
+	c := Change{}
+	parts := strings.SplitN(channel, "__:", 2)
+	if len(parts) != 2 {
+		return c
+	}
+	c.User = strings.TrimPrefix(parts[1], userPrefix)
+	if trace.Enabled() {
+		rc := s.pool.Get()
+		defer rc.Close()
+		c.TraceParent, _ = redis.String(rc.Do("HGET", parts[1], traceField))
+	}
+	return c
+}
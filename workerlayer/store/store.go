@@ -0,0 +1,95 @@
+// store package keeps users and their favorite numbers for worker
+//
+// UserStore is implemented by Redis (shared by all workers, single node or cluster layout)
+// and Memory (one worker process, lost on restart - for development and tests).
+// worker sees changes of all writers through Watch and pushes new list to connections
+package store
+
+import (
+	"errors"
+	"sort"
+	"workerlayer/messages"
+)
+
+//Get and Delete of user that does not exist
+var ErrNotFound = errors.New(messages.ErrUserNotFound)
+
+const (
+	SortByName   = "name"
+	SortByFavnum = "favnum"
+)
+
+type UserStore interface {
+	//create or update user - tp is traceparent of write, "" when tracing is off, watchers get it with change
+	Set(user messages.User, tp string) error
+	Get(name string) (messages.User, error)
+	Delete(name string) error
+	//page of sorted users with version of list
+	List(q Query) (List, error)
+	//change notifications - changes made after Watch returns are delivered
+	Watch() (Watcher, error)
+}
+
+//sort and paging of List - zero value is all users sorted by name
+type Query struct {
+	//SortByName (default) or SortByFavnum - equal numbers are sorted by name
+	SortBy string
+	Desc   bool
+	Offset int
+	//0 - all users from Offset
+	Limit int
+}
+
+type List struct {
+	//version of list - incremented with every change
+	Seq   int64
+	Users []messages.User
+	//users in store, not only in page
+	Total int
+}
+
+//change of one user
+type Change struct {
+	User string
+	//traceparent of write - "" when unknown or tracing is off
+	TraceParent string
+}
+
+type Watcher interface {
+	//changes until watch ends - closed after Close or when watch is lost
+	Changes() <-chan Change
+	//why watch ended - nil after Close, error when it was lost and should be established again
+	Err() error
+	Close() error
+}
+
+//sort users by q and cut page - used by stores that can't sort on server
+func page(users []messages.User, q Query) []messages.User {
+	less := func(a, b messages.User) bool { return a.Username < b.Username }
+	if q.SortBy == SortByFavnum {
+		less = func(a, b messages.User) bool {
+			if a.Favnum != b.Favnum {
+				return a.Favnum < b.Favnum
+			}
+			return a.Username < b.Username
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if q.Desc {
+			return less(users[j], users[i])
+		}
+		return less(users[i], users[j])
+	})
+
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+	if q.Offset > len(users) {
+		q.Offset = len(users)
+	}
+	users = users[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(users) {
+		users = users[:q.Limit]
+	}
+	return users
+}
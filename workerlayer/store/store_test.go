@@ -0,0 +1,161 @@
+package store
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"workerlayer/fakeredis"
+	"workerlayer/messages"
+	"workerlayer/redisconn"
+)
+
+//every implementation passes the same tests
+func stores(t *testing.T) map[string]UserStore {
+	t.Helper()
+	single, err := fakeredis.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(single.Close)
+	opts := redisconn.DefaultOptions()
+	opts.URL = single.URL()
+
+	nodes, err := fakeredis.StartCluster("127.0.0.1:0", "127.0.0.1:0", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copts := redisconn.DefaultOptions()
+	for _, n := range nodes {
+		t.Cleanup(n.Close)
+		copts.Cluster.Addrs = append(copts.Cluster.Addrs, n.Addr())
+	}
+
+	return map[string]UserStore{
+		"memory":        NewMemory(),
+		"redis":         NewRedis(redisconn.NewPool(opts), false),
+		"redis cluster": NewRedis(redisconn.NewPool(copts), true),
+	}
+}
+
+func names(users []messages.User) string {
+	var s []string
+	for _, u := range users {
+		s = append(s, u.Username)
+	}
+	return strings.Join(s, ",")
+}
+
+func TestSetGetDelete(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := s.Get("ana"); err != ErrNotFound {
+				t.Fatal("expected ErrNotFound, got", err)
+			}
+			if err := s.Set(messages.User{Username: "ana", Favnum: 7}, ""); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Set(messages.User{Username: "ana", Favnum: 8}, ""); err != nil {
+				t.Fatal(err)
+			}
+			if u, err := s.Get("ana"); err != nil || u.Favnum != 8 {
+				t.Fatal("get:", u, err)
+			}
+			if err := s.Delete("ana"); err != nil {
+				t.Fatal(err)
+			}
+			before, _ := s.List(Query{})
+			if err := s.Delete("ana"); err != ErrNotFound {
+				t.Fatal("expected ErrNotFound on second delete, got", err)
+			}
+			if after, _ := s.List(Query{}); after.Seq != before.Seq {
+				t.Error("seq changed by delete of missing user:", before.Seq, after.Seq)
+			}
+		})
+	}
+}
+
+func TestListSortAndPaging(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, u := range []messages.User{{Username: "dan", Favnum: 1}, {Username: "ana", Favnum: 3}, {Username: "cid", Favnum: 3}, {Username: "bob", Favnum: 2}} {
+				if err := s.Set(u, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, c := range []struct {
+				q    Query
+				want string
+			}{
+				{Query{}, "ana,bob,cid,dan"},
+				{Query{Desc: true}, "dan,cid,bob,ana"},
+				{Query{SortBy: SortByFavnum}, "dan,bob,ana,cid"},
+				{Query{SortBy: SortByFavnum, Desc: true}, "cid,ana,bob,dan"},
+				{Query{Offset: 1, Limit: 2}, "bob,cid"},
+				{Query{Offset: 3}, "dan"},
+				{Query{Offset: 9}, ""},
+			} {
+				list, err := s.List(c.q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := names(list.Users); got != c.want || list.Total != 4 {
+					t.Errorf("%+v: expected %s of 4, got %s of %d", c.q, c.want, got, list.Total)
+				}
+			}
+			before, _ := s.List(Query{})
+			s.Delete("dan")
+			if after, _ := s.List(Query{}); after.Seq <= before.Seq {
+				t.Error("seq not incremented by change:", before.Seq, after.Seq)
+			}
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			w, err := s.Watch()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Set(messages.User{Username: "eve", Favnum: 1}, "")
+			select {
+			case c := <-w.Changes():
+				if c.User != "eve" {
+					t.Fatal("expected change of eve, got", c)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("no change")
+			}
+
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			//closed after pending changes are read
+			timeout := time.After(2 * time.Second)
+			for open := true; open; {
+				select {
+				case _, open = <-w.Changes():
+				case <-timeout:
+					t.Fatal("changes not closed")
+				}
+			}
+			if err := w.Err(); err != nil {
+				t.Fatal("expected no error after Close, got", err)
+			}
+		})
+	}
+}
+
+//resumed sessions and SSE clients keep seq of previous run
+func TestMemorySeqGrowsAcrossRestart(t *testing.T) {
+	before := NewMemory()
+	for i := 0; i < 3; i++ {
+		before.Set(messages.User{Username: "ana", Favnum: i}, "")
+	}
+	old, _ := before.List(Query{})
+	time.Sleep(time.Millisecond)
+	if list, _ := NewMemory().List(Query{}); list.Seq <= old.Seq {
+		t.Fatal("seq of new store", list.Seq, "not above seq of previous", old.Seq)
+	}
+}
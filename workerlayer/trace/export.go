@@ -0,0 +1,314 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"workerlayer/metrics"
+	"workerlayer/utl"
+)
+
+//////////////////////////////////////////////////////
+// export of finished spans
+//
+// spans are queued and sent in batches by one go routine: every exportPeriod or when batch
+// is full. queue is bounded - when exporter can not keep up spans are dropped, never blocking
+// message flow. both exporters write OTLP JSON (ExportTraceServiceRequest): otlp POSTs it to
+// collector (/v1/traces), file appends it as one line per batch.
+
+const (
+	ExporterNone = "none"
+	ExporterOTLP = "otlp"
+	ExporterFile = "file"
+
+	// spans waiting for export
+	queueSize = 4096
+	// spans in one export request
+	batchSize = 256
+	// period of export of partial batch
+	exportPeriod = 2 * time.Second
+	// time allowed for one OTLP request
+	exportTimeout = 5 * time.Second
+)
+
+var (
+	exported = metrics.NewCounter("trace_spans_exported_total", "Spans sent to exporter.")
+	dropped  = metrics.NewCounter("trace_spans_dropped_total", "Spans dropped, by reason.", "reason")
+)
+
+//tracing options from config
+type Options struct {
+	//none, otlp or file
+	Exporter string `yaml:"exporter" env:"TRACE_EXPORTER" flag:"--trace-exporter"`
+	//OTLP/HTTP traces URL of collector
+	Endpoint string `yaml:"endpoint" env:"TRACE_ENDPOINT" flag:"--trace-endpoint"`
+	//file of file exporter
+	File string `yaml:"file" env:"TRACE_FILE" flag:"--trace-file"`
+}
+
+func DefaultOptions() Options {
+	return Options{Exporter: ExporterNone, Endpoint: "http://localhost:4318/v1/traces"}
+}
+
+func (o Options) Validate() error {
+	switch o.Exporter {
+	case ExporterNone:
+	case ExporterOTLP:
+		u, err := url.Parse(o.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("trace endpoint %q: expected http(s) URL", o.Endpoint)
+		}
+	case ExporterFile:
+		if o.File == "" {
+			return errors.New("trace file is required with file exporter")
+		}
+	default:
+		return fmt.Errorf("trace exporter %q: expected none, otlp or file", o.Exporter)
+	}
+	return nil
+}
+
+type exporter struct {
+	opts    Options
+	service string
+	queue   chan *Span
+	//Flush waits for go routine to drain queue
+	flush  chan chan bool
+	file   *os.File
+	client *http.Client
+}
+
+var (
+	expmux sync.Mutex
+	exp    *exporter
+)
+
+//true when spans are recorded
+func Enabled() bool {
+	expmux.Lock()
+	defer expmux.Unlock()
+	return exp != nil
+}
+
+//start exporter of service with validated options - nothing is recorded with exporter none
+func Init(o Options, service string) error {
+	if o.Exporter == ExporterNone || o.Exporter == "" {
+		return nil
+	}
+	e := &exporter{opts: o, service: service, queue: make(chan *Span, queueSize), flush: make(chan chan bool)}
+	switch o.Exporter {
+	case ExporterFile:
+		f, err := os.OpenFile(o.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		e.file = f
+	case ExporterOTLP:
+		e.client = &http.Client{Timeout: exportTimeout}
+	}
+	go e.run()
+
+	expmux.Lock()
+	exp = e
+	expmux.Unlock()
+	utl.INFO("trace", "exporting spans of", service, "to", o.Exporter, o.Endpoint+o.File)
+	return nil
+}
+
+//export queued spans - called on shutdown
+func Flush(timeout time.Duration) {
+	expmux.Lock()
+	e := exp
+	expmux.Unlock()
+	if e == nil {
+		return
+	}
+	done := make(chan bool)
+	select {
+	case e.flush <- done:
+		select {
+		case <-done:
+		case <-time.After(timeout):
+		}
+	case <-time.After(timeout):
+	}
+}
+
+//queue finished span - unsampled spans are not exported
+func record(s *Span) {
+	if s.ctx.Flags&1 == 0 {
+		return
+	}
+	expmux.Lock()
+	e := exp
+	expmux.Unlock()
+	if e == nil {
+		return
+	}
+	select {
+	case e.queue <- s:
+	default:
+		dropped.Inc("queue_full")
+	}
+}
+
+func (e *exporter) run() {
+	ticker := time.NewTicker(exportPeriod)
+	defer ticker.Stop()
+	var batch []*Span
+	send := func() {
+		if len(batch) > 0 {
+			e.export(batch)
+			batch = nil
+		}
+	}
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-e.flush:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+			send()
+			close(done)
+		}
+	}
+}
+
+func (e *exporter) export(batch []*Span) {
+	data := utl.JSON(e.request(batch))
+	var err error
+	switch e.opts.Exporter {
+	case ExporterFile:
+		_, err = e.file.Write(append(data, '\n'))
+	case ExporterOTLP:
+		err = e.post(data)
+	}
+	if err != nil {
+		utl.WARN("trace", "export", len(batch), "spans", err)
+		dropped.Add(float64(len(batch)), "export_failed")
+		return
+	}
+	exported.Add(float64(len(batch)))
+}
+
+func (e *exporter) post(data []byte) error {
+	rp, err := e.client.Post(e.opts.Endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	rp.Body.Close()
+	if rp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector replied %s", rp.Status)
+	}
+	return nil
+}
+
+///////////////////
+// OTLP JSON
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              Kind           `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatus struct {
+	//0 unset, 2 error
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func keyValue(k, v string) otlpKeyValue {
+	kv := otlpKeyValue{Key: k}
+	kv.Value.StringValue = v
+	return kv
+}
+
+func (e *exporter) request(batch []*Span) otlpRequest {
+	scope := otlpScopeSpans{}
+	scope.Scope.Name = "workerlayer/trace"
+	for _, s := range batch {
+		scope.Spans = append(scope.Spans, s.otlp())
+	}
+	rs := otlpResourceSpans{
+		Resource:   otlpResource{Attributes: []otlpKeyValue{keyValue("service.name", e.service)}},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{rs}}
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.ctx.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.ctx.SpanID[:]),
+		Name:              s.Name,
+		Kind:              s.Kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parent != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	keys := make([]string, 0, len(s.attrs))
+	for k := range s.attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		o.Attributes = append(o.Attributes, keyValue(k, s.attrs[k]))
+	}
+	if s.err != "" {
+		o.Status = otlpStatus{Code: 2, Message: s.err}
+	}
+	return o
+}
@@ -0,0 +1,152 @@
+// trace package records spans and propagates W3C trace context between weblayer and worker
+//
+// context travels as traceparent "00-{trace id}-{span id}-{flags}" in TraceParent field of
+// client requests and replies, and as a field of changed user in redis, so a push caused by
+// a change is in the same trace as the request that made the change:
+//
+//	client --TraceParent--> weblayer.request --conn.{id}--> worker.process --> worker.setData
+//	                                                                               | user:{name} trace
+//	client <-- weblayer.deliver <--worker.{id}-- worker.push <--keyspace event------
+//
+// finished spans are exported in batches as OTLP/HTTP JSON or as JSON lines to a file.
+// when tracing is off, Start returns nil and methods of nil *Span do nothing.
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+//kind of span - values of OTLP SpanKind
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+	KindProducer Kind = 4
+	KindConsumer Kind = 5
+)
+
+//trace id, span id and flags of traceparent
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+//parse traceparent - false when it is empty or malformed
+func Parse(traceparent string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	//version 00 has exactly 4 parts, later versions may add more
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	sc.Flags = flags[0]
+	return sc, sc.Valid()
+}
+
+//trace and span id are not all zeros
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+//traceparent header value
+func (sc SpanContext) String() string {
+	return fmt.Sprintf("00-%x-%x-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+//unit of work between Start and End
+type Span struct {
+	Name   string
+	Kind   Kind
+	ctx    SpanContext
+	parent [8]byte
+	start  time.Time
+	end    time.Time
+
+	mux   sync.Mutex
+	attrs map[string]string
+	err   string
+	ended bool
+}
+
+//start span with parent traceparent - new trace when parent is empty or malformed
+//returns nil when tracing is off
+func Start(name string, kind Kind, parent string) *Span {
+	if !Enabled() {
+		return nil
+	}
+	s := &Span{Name: name, Kind: kind, start: time.Now(), attrs: make(map[string]string)}
+	if sc, ok := Parse(parent); ok {
+		s.ctx.TraceID = sc.TraceID
+		s.ctx.Flags = sc.Flags
+		s.parent = sc.SpanID
+	} else {
+		rand.Read(s.ctx.TraceID[:])
+		s.ctx.Flags = 1 //sampled
+	}
+	rand.Read(s.ctx.SpanID[:])
+	return s
+}
+
+//traceparent of span for children - "" for nil span
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return s.ctx.String()
+}
+
+func (s *Span) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	s.attrs[key] = value
+	s.mux.Unlock()
+}
+
+//mark span failed - nil err is ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mux.Lock()
+	s.err = err.Error()
+	s.mux.Unlock()
+}
+
+//finish span and queue it for export - second End is ignored
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	if s.ended {
+		s.mux.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mux.Unlock()
+	record(s)
+}
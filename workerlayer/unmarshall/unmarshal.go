@@ -45,6 +45,27 @@ func smartUnmarshall(message []byte) messages.ClientRequest {
 			return nil
 		}
 		return cmd
+	case messages.RQGetUser:
+		cmd := messages.ClientGetUser{}
+		err = json.Unmarshal(message, &cmd)
+		if err != nil {
+			return nil
+		}
+		return cmd
+	case messages.RQDeleteUser:
+		cmd := messages.ClientDeleteUser{}
+		err = json.Unmarshal(message, &cmd)
+		if err != nil {
+			return nil
+		}
+		return cmd
+	case messages.RQListOnline:
+		cmd := messages.ClientListOnline{}
+		err = json.Unmarshal(message, &cmd)
+		if err != nil {
+			return nil
+		}
+		return cmd
 	case messages.RQUnknown:
 		utl.ERR("Unknown command - not initialized structs on client")
 	default:
@@ -1,29 +1,113 @@
 package usage
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"workerlayer/config"
+	"workerlayer/redisconn"
+	"workerlayer/trace"
+	"workerlayer/utl"
+
 	"github.com/docopt/docopt-go"
 )
 
 var usage = `workerlayer
 
 Usage:
-  workerlayer [--port=port] [--redis=ip] 
+  workerlayer [--config=file] [--port=port] [--redis-url=url] [--redis=ip] [--redis-port=n] [--redis-db=n] [--redis-sentinel-master=name] [--redis-sentinel=addr]... [--redis-cluster=addr]... [--store=s] [--log-format=f] [--log-level=l] [--trace-exporter=e] [--trace-endpoint=url] [--trace-file=file]
   workerlayer -h | --help
   workerlayer --version
 
 Options:
   -h --help             Show this screen.
   --version             Show version.
-  --port=port           Listening port of service
-  --redis=ip            Redis server 
+  --config=file         YAML config file [env WORKERLAYER_CONFIG]
+  --port=port           Listening port of health/metrics http [env WORKERLAYER_PORT, default 8889]
+  --redis-url=url       Redis URL redis://[user:password@]host:port/db or rediss:// for TLS [env WORKERLAYER_REDIS_URL]
+  --redis=ip            Redis server [env WORKERLAYER_REDIS, default 127.0.0.1]
+  --redis-port=n        Redis port [env WORKERLAYER_REDIS_PORT, default 6379]
+  --redis-db=n          Redis database, overrides db of --redis-url [env WORKERLAYER_REDIS_DB, default db of URL, else 0]
+  --redis-sentinel-master=name  Discover primary of this master through sentinels [env WORKERLAYER_REDIS_SENTINEL_MASTER]
+  --redis-sentinel=addr  Sentinel host:port, repeat for every sentinel [env WORKERLAYER_REDIS_SENTINEL_ADDRS, separated by ;]
+  --redis-cluster=addr  Redis Cluster node host:port, repeat for more seed nodes [env WORKERLAYER_REDIS_CLUSTER_ADDRS, separated by ;]
+  --store=s             User data in redis (shared by workers) or memory (this worker only, lost on restart) [env WORKERLAYER_STORE, default redis]
+  --log-format=f        Log output text or json [env WORKERLAYER_LOG_FORMAT, default text]
+  --log-level=l         debug, notice, info, warn or error [env WORKERLAYER_LOG_LEVEL, default info]
+  --trace-exporter=e    Export spans: none, otlp or file [env WORKERLAYER_TRACE_EXPORTER, default none]
+  --trace-endpoint=url  OTLP/HTTP traces URL [env WORKERLAYER_TRACE_ENDPOINT, default http://localhost:4318/v1/traces]
+  --trace-file=file     JSON lines file of file exporter [env WORKERLAYER_TRACE_FILE]
+
+Redis username/password, TLS certificates and pool are set only in config file or env
+(WORKERLAYER_REDIS_USERNAME, WORKERLAYER_REDIS_PASSWORD, WORKERLAYER_REDIS_TLS_*, WORKERLAYER_REDIS_POOL_*,
+WORKERLAYER_REDIS_SENTINEL_PASSWORD).
+Precedence: defaults < config file < env < flags.
   `
 
-func Redis() string {
+//environment variables are WORKERLAYER_{env tag}
+const envPrefix = "WORKERLAYER"
+
+//user stores
+const (
+	StoreRedis  = "redis"
+	StoreMemory = "memory"
+)
+
+//configuration of workerlayer
+type Config struct {
+	Port    string            `yaml:"port" env:"PORT" flag:"--port"`
+	Redis   redisconn.Options `yaml:"redis"`
+	Store   string            `yaml:"store" env:"STORE" flag:"--store"`
+	Log     utl.LogOptions    `yaml:"log"`
+	Tracing trace.Options     `yaml:"tracing"`
+}
+
+//configuration with defaults
+func Default() *Config {
+	return &Config{
+		Port:    "8889",
+		Redis:   redisconn.DefaultOptions(),
+		Store:   StoreRedis,
+		Log:     utl.DefaultLogOptions(),
+		Tracing: trace.DefaultOptions(),
+	}
+}
+
+//parse command line once and load configuration from all sources
+func Load() (*Config, error) {
 	arguments, _ := docopt.Parse(usage, nil, true, "workerlayer 2.0", false)
-	path := arguments["--redis"]
-	if path == nil {
-		return "127.0.0.1"
+	file, _ := arguments["--config"].(string)
+	if file == "" {
+		file = os.Getenv(envPrefix + "_CONFIG")
 	}
 
-	return path.(string)
+	cfg := Default()
+	if err := config.Load(cfg, file, envPrefix, arguments); err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.Port == "" {
+		return errors.New("port is required")
+	}
+	if err := cfg.Redis.Validate(); err != nil {
+		return fmt.Errorf("redis: %v", err)
+	}
+	if cfg.Store != StoreRedis && cfg.Store != StoreMemory {
+		return fmt.Errorf("store %q: expected redis or memory", cfg.Store)
+	}
+	if err := cfg.Log.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.Tracing.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+//effective configuration for log, secrets redacted
+func (cfg *Config) Print() []string {
+	return config.Print(cfg)
 }
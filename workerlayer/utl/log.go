@@ -0,0 +1,179 @@
+package utl
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+///////////////////////////
+// log output - text (coloured lines) or json (one object per line)
+//
+// level functions ERR/WARN/INFO/NOTICE/DEBUG log without fields, With(fields) returns
+// logger that adds connection id, request id, command, remote address and duration.
+// in json mode fields are keys of the object, in text mode they are key=value before message:
+//
+//	{"time":"2024-05-01T10:00:00.123Z","level":"info","msg":"request done","conn_id":"8c1f..","cmd":"RQSetFavoriteNumber","duration_ms":1.2}
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+//level names in order of SetTraceLevel - level n logs everything from n up
+var levelNames = []string{"debug", "notice", "info", "warn", "error"}
+
+var (
+	_format = FormatText
+	//json lines are written directly, not through log.Printf
+	outmux sync.Mutex
+)
+
+//log options from config
+type LogOptions struct {
+	//text or json
+	Format string `yaml:"format" env:"LOG_FORMAT" flag:"--log-format"`
+	//debug, notice, info, warn or error
+	Level string `yaml:"level" env:"LOG_LEVEL" flag:"--log-level"`
+}
+
+func DefaultLogOptions() LogOptions {
+	return LogOptions{Format: FormatText, Level: "info"}
+}
+
+func (o LogOptions) Validate() error {
+	if o.Format != FormatText && o.Format != FormatJSON {
+		return fmt.Errorf("log format %q: expected text or json", o.Format)
+	}
+	if levelOf(o.Level) < 0 {
+		return fmt.Errorf("log level %q: expected one of %s", o.Level, strings.Join(levelNames, ", "))
+	}
+	return nil
+}
+
+//apply validated options to level functions and loggers
+func ConfigureLog(o LogOptions) {
+	_format = o.Format
+	SetTraceLevel(levelOf(o.Level))
+}
+
+func levelOf(name string) int {
+	for i, n := range levelNames {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+//context of log line - empty fields are left out
+type Fields struct {
+	ConnID     string        `json:"conn_id,omitempty"`
+	RequestID  string        `json:"request_id,omitempty"`
+	Cmd        string        `json:"cmd,omitempty"`
+	RemoteAddr string        `json:"remote_addr,omitempty"`
+	Duration   time.Duration `json:"-"`
+}
+
+//logger with fields
+type Logger struct {
+	fields Fields
+}
+
+func With(f Fields) Logger {
+	return Logger{fields: f}
+}
+
+//logger with more fields - non-empty ones replace current
+func (l Logger) With(f Fields) Logger {
+	if f.ConnID != "" {
+		l.fields.ConnID = f.ConnID
+	}
+	if f.RequestID != "" {
+		l.fields.RequestID = f.RequestID
+	}
+	if f.Cmd != "" {
+		l.fields.Cmd = f.Cmd
+	}
+	if f.RemoteAddr != "" {
+		l.fields.RemoteAddr = f.RemoteAddr
+	}
+	if f.Duration != 0 {
+		l.fields.Duration = f.Duration
+	}
+	return l
+}
+
+func (l Logger) ERR(v ...interface{})    { output(4, &l.fields, v) }
+func (l Logger) WARN(v ...interface{})   { output(3, &l.fields, v) }
+func (l Logger) INFO(v ...interface{})   { output(2, &l.fields, v) }
+func (l Logger) NOTICE(v ...interface{}) { output(1, &l.fields, v) }
+func (l Logger) DEBUG(v ...interface{})  { output(0, &l.fields, v) }
+
+//colour of level in text mode - {start, end}
+var colours = [][2]string{
+	{"\033[1;35m", " \033[0m"},
+	{"", ""},
+	{"\033[32m", " \033[0m"},
+	{"\033[1;33m", " \033[0m"},
+	{"\033[1;4;31m", " \033[0m"},
+}
+
+//write line of level if it is enabled
+func output(level int, f *Fields, v []interface{}) {
+	if level < _level {
+		return
+	}
+	msg := strings.TrimRight(fmt.Sprintln(v...), "\n")
+	if _format == FormatJSON {
+		writeJSON(level, f, msg)
+		return
+	}
+	if f != nil {
+		msg = f.text() + msg
+	}
+	c := colours[level]
+	log.Printf("%s[%s] %v%s\n", c[0], strings.ToUpper(levelNames[level]), msg, c[1])
+}
+
+func writeJSON(level int, f *Fields, msg string) {
+	line := struct {
+		Time  string `json:"time"`
+		Level string `json:"level"`
+		Msg   string `json:"msg"`
+		Fields
+		DurationMS float64 `json:"duration_ms,omitempty"`
+	}{Time: time.Now().UTC().Format(time.RFC3339Nano), Level: levelNames[level], Msg: msg}
+	if f != nil {
+		line.Fields = *f
+		line.DurationMS = float64(f.Duration) / float64(time.Millisecond)
+	}
+	data, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+	outmux.Lock()
+	defer outmux.Unlock()
+	log.Writer().Write(append(data, '\n'))
+}
+
+//"key=value " of non-empty fields
+func (f *Fields) text() string {
+	var b strings.Builder
+	add := func(k, v string) {
+		if v != "" {
+			fmt.Fprintf(&b, "%s=%s ", k, v)
+		}
+	}
+	add("conn_id", f.ConnID)
+	add("request_id", f.RequestID)
+	add("cmd", f.Cmd)
+	add("remote_addr", f.RemoteAddr)
+	if f.Duration != 0 {
+		add("duration", f.Duration.String())
+	}
+	return b.String()
+}
@@ -18,7 +18,7 @@ var (
 )
 
 func init() {
-	//TODO: read this flag from config
+	//info until ConfigureLog applies log level from config
 	_level = 2
 }
 
@@ -90,40 +90,29 @@ func LogRecover(goname string, r interface{}) {
 //defalut level 2 - includes error, warn and info
 //level 1 - includes error, warn, info and notice
 //level 0 - DEBUG - includes error, warn, info, notice and debug
+//level 3 - warn and error, level 4 - error only
 func SetTraceLevel(level int) {
 	_level = level
 }
 
 func ERR(v ...interface{}) {
-
-	if _level < 5 {
-		log.Printf("\033[1;4;31m[ERROR] %v \033[0m\n", strings.TrimRight(fmt.Sprintln(v...), "\n"))
-	}
-
+	output(4, nil, v)
 }
 
 func WARN(v ...interface{}) {
-	if _level < 4 {
-		log.Printf("\033[1;33m[WARN] %v \033[0m\n", strings.TrimRight(fmt.Sprintln(v...), "\n"))
-	}
+	output(3, nil, v)
 }
 
 func INFO(v ...interface{}) {
-	if _level < 3 {
-		log.Printf("\033[32m[INFO] %v \033[0m\n", strings.TrimRight(fmt.Sprintln(v...), "\n"))
-	}
+	output(2, nil, v)
 }
 
 func NOTICE(v ...interface{}) {
-	if _level < 2 {
-		log.Printf("[NOTICE] %v\n", strings.TrimRight(fmt.Sprintln(v...), "\n"))
-	}
+	output(1, nil, v)
 }
 
 func DEBUG(v ...interface{}) {
-	if _level < 1 {
-		log.Printf("\033[1;35m[DEBUG] %v \033[0m\n", strings.TrimRight(fmt.Sprintln(v...), "\n"))
-	}
+	output(0, nil, v)
 }
 
 //////////////////////////////////////
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"wsclient"
+)
+
+const replHelp = `commands:
+  set <user> <number>   set favorite number of user
+  get <user>            show user
+  delete <user>         delete user
+  list                  list all users
+  online                list online users
+  watch                 live list of users, ctrl+c stops it
+  help                  this help
+  quit                  exit`
+
+//unknown command or wrong number of arguments
+var errUsage = errors.New("invalid command, try help")
+
+//run one command - args are command and its arguments
+func run(c *wsclient.Client, out *printer, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	switch {
+	case args[0] == "set" && len(args) == 3:
+		number, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("favorite number %q is not a number", args[2])
+		}
+		if err := c.SetFavoriteNumber(args[1], number); err != nil {
+			return err
+		}
+		out.set(args[1], number)
+	case args[0] == "get" && len(args) == 2:
+		user, err := c.GetUser(args[1])
+		if err != nil {
+			return err
+		}
+		out.user(user)
+	case args[0] == "delete" && len(args) == 2:
+		if err := c.DeleteUser(args[1]); err != nil {
+			return err
+		}
+		out.deleted(args[1])
+	case args[0] == "list" && len(args) == 1:
+		list, err := c.ListUsers()
+		if err != nil {
+			return err
+		}
+		out.list(list)
+	case args[0] == "online" && len(args) == 1:
+		users, err := c.ListOnline()
+		if err != nil {
+			return err
+		}
+		out.online(users)
+	case args[0] == "watch" && len(args) == 1:
+		return watch(c, out)
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+//print current list and every push until interrupted
+func watch(c *wsclient.Client, out *printer) error {
+	list, err := c.ListUsers()
+	if err != nil {
+		return err
+	}
+	//events that came before watch are old news
+	for len(c.Events) > 0 {
+		<-c.Events
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	defer signal.Stop(stop)
+
+	out.watch(list, c.Connected())
+	for {
+		select {
+		case push := <-c.Lists:
+			//pushes queued before watch are older than the list we show
+			if push.Seq >= list.Seq {
+				list = push
+				out.watch(list, c.Connected())
+			}
+		case e := <-c.Events:
+			out.event(e)
+			out.watch(list, c.Connected())
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+//read commands from stdin until quit or EOF
+func repl(c *wsclient.Client, out *printer) {
+	fmt.Println("connected - type help for commands")
+	in := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("> ")
+		if !in.Scan() {
+			fmt.Println()
+			return
+		}
+		args := strings.Fields(in.Text())
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "quit", "exit":
+			return
+		case "help":
+			fmt.Println(replHelp)
+			continue
+		}
+		if err := run(c, out, args); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+	}
+}
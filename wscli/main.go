@@ -0,0 +1,117 @@
+// wscli is command line client of weblayer
+//
+// requests go over websocket with wsclient package - same path as browser and service clients.
+// every command can run once from shell or in REPL, which keeps one connection open:
+//
+//	wscli set ana 22
+//	wscli --output=json list
+//	wscli watch
+//	wscli          (REPL)
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"workerlayer/utl"
+	"wsclient"
+
+	"github.com/docopt/docopt-go"
+)
+
+var usage = `wscli
+
+Usage:
+  wscli [options] set <user> <number>
+  wscli [options] get <user>
+  wscli [options] delete <user>
+  wscli [options] list
+  wscli [options] online
+  wscli [options] watch
+  wscli [options] [repl]
+  wscli -h | --help
+  wscli --version
+
+Options:
+  -h --help         Show this screen.
+  --version         Show version.
+  --url=url         Websocket endpoint [env WSCLI_URL, default ws://localhost:9999/ws]
+  --token=token     User token for authenticated requests [env WSCLI_TOKEN]
+  --output=format   Output table or json [env WSCLI_OUTPUT, default table]
+  --timeout=d       Time allowed for reply [env WSCLI_TIMEOUT, default 10s]
+  --subscribe=list  Push topics separated by comma, e.g. presence - watch shows join/leave events [env WSCLI_SUBSCRIBE]
+
+Without command wscli starts REPL - commands are the same, e.g. "set ana 22", "help" lists them.
+  `
+
+func main() {
+	arguments, _ := docopt.Parse(usage, nil, true, "wscli 2.0", false)
+
+	out, err := newPrinter(option(arguments, "--output", "WSCLI_OUTPUT", formatTable))
+	if err != nil {
+		fail(err)
+	}
+	timeout, err := time.ParseDuration(option(arguments, "--timeout", "WSCLI_TIMEOUT", "10s"))
+	if err != nil {
+		fail(fmt.Errorf("timeout: %v", err))
+	}
+
+	//client logs reconnects - keep output of commands clean
+	utl.ConfigureLog(utl.LogOptions{Format: utl.FormatText, Level: "warn"})
+
+	opts := wsclient.DefaultOptions(option(arguments, "--url", "WSCLI_URL", "ws://localhost:9999/ws"))
+	opts.Token = option(arguments, "--token", "WSCLI_TOKEN", "")
+	opts.RequestTimeout = timeout
+	if topics := option(arguments, "--subscribe", "WSCLI_SUBSCRIBE", ""); topics != "" {
+		opts.Subscribe = strings.Split(topics, ",")
+	}
+	c, err := wsclient.Dial(opts)
+	if err != nil {
+		fail(err)
+	}
+	defer c.Close()
+
+	args := command(arguments)
+	if args == nil {
+		repl(c, out)
+		return
+	}
+	if err := run(c, out, args); err != nil {
+		c.Close()
+		fail(err)
+	}
+}
+
+//flag, env or default - in that order
+func option(arguments map[string]interface{}, flag, env, def string) string {
+	if v, _ := arguments[flag].(string); v != "" {
+		return v
+	}
+	if v := os.Getenv(env); v != "" {
+		return v
+	}
+	return def
+}
+
+//command words from parsed arguments - nil for REPL
+func command(arguments map[string]interface{}) []string {
+	for _, cmd := range []string{"set", "get", "delete", "list", "online", "watch"} {
+		if on, _ := arguments[cmd].(bool); !on {
+			continue
+		}
+		args := []string{cmd}
+		for _, arg := range []string{"<user>", "<number>"} {
+			if v, ok := arguments[arg].(string); ok {
+				args = append(args, v)
+			}
+		}
+		return args
+	}
+	return nil
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "wscli:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+	"workerlayer/messages"
+	"workerlayer/utl"
+)
+
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	//events shown under live table
+	watchEvents = 5
+)
+
+//writes results as aligned table or as one JSON document per line
+type printer struct {
+	json bool
+	w    io.Writer
+	//last events shown by watch
+	events []string
+}
+
+func newPrinter(format string) (*printer, error) {
+	if format != formatTable && format != formatJSON {
+		return nil, fmt.Errorf("output %q: expected table or json", format)
+	}
+	return &printer{json: format == formatJSON, w: os.Stdout}, nil
+}
+
+func (p *printer) set(name string, number int) {
+	if p.json {
+		p.writeJSON(messages.User{Username: name, Favnum: number})
+		return
+	}
+	fmt.Fprintf(p.w, "%s = %d\n", name, number)
+}
+
+func (p *printer) user(u messages.User) {
+	if p.json {
+		p.writeJSON(u)
+		return
+	}
+	p.table([]messages.User{u})
+}
+
+func (p *printer) deleted(name string) {
+	if p.json {
+		p.writeJSON(struct{ Deleted string }{name})
+		return
+	}
+	fmt.Fprintln(p.w, "deleted", name)
+}
+
+func (p *printer) list(list messages.AllUserlist) {
+	if p.json {
+		p.writeJSON(users(list))
+		return
+	}
+	p.table(list.AllUsers)
+}
+
+func (p *printer) online(users []string) {
+	if users == nil {
+		users = []string{}
+	}
+	if p.json {
+		p.writeJSON(users)
+		return
+	}
+	if len(users) == 0 {
+		fmt.Fprintln(p.w, "nobody is online")
+	}
+	for _, u := range users {
+		fmt.Fprintln(p.w, u)
+	}
+}
+
+//redraw live table - in json mode every list is one line
+func (p *printer) watch(list messages.AllUserlist, connected bool) {
+	if p.json {
+		p.writeJSON(list)
+		return
+	}
+	state := "connected"
+	if !connected {
+		state = "reconnecting"
+	}
+	//clear screen and move cursor home
+	fmt.Fprint(p.w, "\033[H\033[2J")
+	fmt.Fprintf(p.w, "users (version %d) - %s %s - ctrl+c to stop\n\n", list.Seq, state, time.Now().Format("15:04:05"))
+	p.table(list.AllUsers)
+	if len(p.events) > 0 {
+		fmt.Fprintln(p.w)
+	}
+	for _, e := range p.events {
+		fmt.Fprintln(p.w, e)
+	}
+}
+
+//announcement or presence event - in table mode kept for next redraw
+func (p *printer) event(e interface{}) {
+	if p.json {
+		p.writeJSON(e)
+		return
+	}
+	line := time.Now().Format("15:04:05 ")
+	switch e := e.(type) {
+	case messages.Announcement:
+		line += fmt.Sprintf("[%s] %s", e.Level, e.Text)
+	case messages.Presence:
+		line += fmt.Sprintf("%s %s", e.User, e.Event)
+	}
+	p.events = append(p.events, line)
+	if len(p.events) > watchEvents {
+		p.events = p.events[len(p.events)-watchEvents:]
+	}
+}
+
+func (p *printer) table(users []messages.User) {
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tFAVORITE NUMBER")
+	for _, u := range users {
+		fmt.Fprintf(tw, "%s\t%d\n", u.Username, u.Favnum)
+	}
+	tw.Flush()
+}
+
+func (p *printer) writeJSON(v interface{}) {
+	fmt.Fprintln(p.w, string(utl.JSON(v)))
+}
+
+//users of list, [] instead of null
+func users(list messages.AllUserlist) []messages.User {
+	if list.AllUsers == nil {
+		return []messages.User{}
+	}
+	return list.AllUsers
+}
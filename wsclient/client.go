@@ -0,0 +1,450 @@
+// wsclient package is Go client of weblayer websocket protocol
+//
+// requests are blocking calls built on workerlayer/messages - every request gets RequestID and
+// call waits for reply with the same id. pushes (user lists, announcements, presence) come on
+// Lists and Events channels. when connection is lost client reconnects with exponential backoff
+// and resumes its session, so pushes it already got are not repeated. both channels are closed
+// after Close, so ranging over them ends.
+//
+//	c, err := wsclient.Dial(wsclient.DefaultOptions("ws://localhost:9999/ws"))
+//	err = c.SetFavoriteNumber("ana", 22)
+//	list := <-c.Lists
+package wsclient
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+	"workerlayer/messages"
+	"workerlayer/utl"
+
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+)
+
+var (
+	ErrNotFound     = errors.New(messages.ErrUserNotFound)
+	ErrTimeout      = errors.New("timeout waiting for reply")
+	ErrNotConnected = errors.New("not connected")
+	ErrClosed       = errors.New("client closed")
+	//connection was lost before reply came - request may or may not be done
+	ErrConnectionLost = errors.New("connection lost")
+)
+
+const (
+	//pushes kept for slow consumer - oldest are dropped when channel is full
+	pushBuffer = 16
+	//time allowed for session message after dial
+	handshakeWait = 10 * time.Second
+)
+
+type Options struct {
+	//websocket endpoint, e.g. ws://localhost:9999/ws
+	URL string
+	//user token - anonymous when empty
+	Token string
+	//labels for targeted announcements
+	Tags []string
+	//push topics, e.g. presence
+	Subscribe []string
+	//extra headers of upgrade request, e.g. traceparent
+	Header http.Header
+
+	//pong wait of server endpoint - connection is dead when server did not ping for this long
+	PongWait time.Duration
+	//time allowed to write a message to server
+	WriteWait time.Duration
+	//time allowed for reply to request
+	RequestTimeout time.Duration
+	//delay before first reconnect, doubled up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+//options matching defaults of weblayer
+func DefaultOptions(url string) Options {
+	return Options{
+		URL:            url,
+		PongWait:       600 * time.Second,
+		WriteWait:      10 * time.Second,
+		RequestTimeout: 10 * time.Second,
+		MinBackoff:     500 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+	}
+}
+
+type Client struct {
+	//pushed user lists - newest list is whole state, so older are dropped for slow consumer.
+	//closed after Close
+	Lists <-chan messages.AllUserlist
+	//announcements (messages.Announcement) and presence events (messages.Presence) - closed after Close
+	Events <-chan interface{}
+
+	opts   Options
+	lists  chan messages.AllUserlist
+	events chan interface{}
+
+	mux sync.Mutex
+	//nil while reconnecting
+	ws *websocket.Conn
+	//session token - sent on reconnect
+	session string
+	//reply channels by RequestID
+	pending map[string]chan []byte
+
+	//gorilla allows one concurrent writer
+	wmux   sync.Mutex
+	closed chan bool
+	once   sync.Once
+}
+
+//connect to weblayer - first connection must succeed, later ones are retried in background
+func Dial(opts Options) (*Client, error) {
+	c := &Client{
+		opts:    opts,
+		lists:   make(chan messages.AllUserlist, pushBuffer),
+		events:  make(chan interface{}, pushBuffer),
+		pending: make(map[string]chan []byte),
+		closed:  make(chan bool),
+	}
+	c.Lists = c.lists
+	c.Events = c.events
+
+	ws, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	go c.run(ws)
+	return c, nil
+}
+
+//stop reconnecting and close connection
+func (c *Client) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.mux.Lock()
+		ws := c.ws
+		c.mux.Unlock()
+		if ws != nil {
+			ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			ws.Close()
+		}
+	})
+	return nil
+}
+
+//true while there is a live connection
+func (c *Client) Connected() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.ws != nil
+}
+
+/////////////////////
+//REQUESTS
+
+//set user's favorite number - user is created when it does not exist
+func (c *Client) SetFavoriteNumber(user string, number int) error {
+	rq := messages.ClientSetFavoriteNumber{
+		ClientRQ: messages.ClientRQ{Cmd: messages.RQSetFavoriteNumber},
+		CmdData:  messages.SetFavoriteNumber{UserName: user, FavoriteNumber: number},
+	}
+	return c.call(&rq.ClientRQ, &rq, &messages.Reply{})
+}
+
+//all users sorted by name
+func (c *Client) ListUsers() (messages.AllUserlist, error) {
+	rq := messages.ClientGetList{ClientRQ: messages.ClientRQ{Cmd: messages.RQListAllUsers}}
+	rp := messages.AllUserlist{}
+	err := c.call(&rq.ClientRQ, &rq, &rp)
+	return rp, err
+}
+
+//one user - ErrNotFound when it does not exist
+func (c *Client) GetUser(name string) (messages.User, error) {
+	rq := messages.ClientGetUser{ClientRQ: messages.ClientRQ{Cmd: messages.RQGetUser}, CmdData: messages.GetUser{UserName: name}}
+	rp := messages.UserReply{}
+	err := c.call(&rq.ClientRQ, &rq, &rp)
+	return rp.User, err
+}
+
+//delete user - ErrNotFound when it does not exist
+func (c *Client) DeleteUser(name string) error {
+	rq := messages.ClientDeleteUser{ClientRQ: messages.ClientRQ{Cmd: messages.RQDeleteUser}, CmdData: messages.DeleteUser{UserName: name}}
+	return c.call(&rq.ClientRQ, &rq, &messages.Reply{})
+}
+
+//authenticated users that are online
+func (c *Client) ListOnline() ([]string, error) {
+	rq := messages.ClientListOnline{ClientRQ: messages.ClientRQ{Cmd: messages.RQListOnline}}
+	rp := messages.OnlineUsers{}
+	err := c.call(&rq.ClientRQ, &rq, &rp)
+	return rp.Users, err
+}
+
+//send rq with fresh RequestID in hdr and unmarshal reply into rp
+//rp embeds messages.Reply - its Status decides error
+func (c *Client) call(hdr *messages.ClientRQ, rq interface{}, rp interface{}) error {
+	select {
+	case <-c.closed:
+		return ErrClosed
+	default:
+	}
+	hdr.RequestID = uuid.New()
+	wait := make(chan []byte, 1)
+
+	c.mux.Lock()
+	ws := c.ws
+	if ws != nil {
+		c.pending[hdr.RequestID] = wait
+	}
+	c.mux.Unlock()
+	if ws == nil {
+		return ErrNotConnected
+	}
+	defer func() {
+		c.mux.Lock()
+		delete(c.pending, hdr.RequestID)
+		c.mux.Unlock()
+	}()
+
+	if err := c.write(ws, utl.JSON(rq)); err != nil {
+		return err
+	}
+
+	select {
+	case m, ok := <-wait:
+		if !ok {
+			return ErrConnectionLost
+		}
+		if err := json.Unmarshal(m, rp); err != nil {
+			return err
+		}
+		status := messages.Reply{}
+		json.Unmarshal(m, &status)
+		return replyError(status)
+	case <-time.After(c.opts.RequestTimeout):
+		return ErrTimeout
+	case <-c.closed:
+		return ErrClosed
+	}
+}
+
+//nil for OK reply
+func replyError(rp messages.Reply) error {
+	if rp.Status == messages.StatusOK {
+		return nil
+	}
+	if rp.Error == messages.ErrUserNotFound {
+		return ErrNotFound
+	}
+	return errors.New(rp.Error)
+}
+
+func (c *Client) write(ws *websocket.Conn, m []byte) error {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+	ws.SetWriteDeadline(time.Now().Add(c.opts.WriteWait))
+	return ws.WriteMessage(websocket.TextMessage, m)
+}
+
+/////////////////////
+//CONNECTION
+
+//dial endpoint with session of previous connection and wait for session message
+func (c *Client) connect() (*websocket.Conn, error) {
+	u, err := url.Parse(c.opts.URL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	c.mux.Lock()
+	if c.session != "" {
+		q.Set("session", c.session)
+	}
+	c.mux.Unlock()
+	for _, t := range c.opts.Tags {
+		q.Add("tag", t)
+	}
+	for _, s := range c.opts.Subscribe {
+		q.Add("subscribe", s)
+	}
+	u.RawQuery = q.Encode()
+
+	header := http.Header{}
+	for k, v := range c.opts.Header {
+		header[k] = v
+	}
+	if c.opts.Token != "" {
+		header.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(u.String(), header)
+	if err != nil {
+		return nil, err
+	}
+
+	//first message is session token
+	ws.SetReadDeadline(time.Now().Add(handshakeWait))
+	_, m, err := ws.ReadMessage()
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+	sess := messages.Session{}
+	if err := json.Unmarshal(m, &sess); err != nil || sess.Cmd != messages.SrvSession {
+		ws.Close()
+		return nil, errors.New("expected session message, got " + string(m))
+	}
+
+	//server pings every ping period - every ping and message proves connection is alive
+	alive := func() { ws.SetReadDeadline(time.Now().Add(c.opts.PongWait)) }
+	alive()
+	ws.SetPingHandler(func(data string) error {
+		alive()
+		return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(c.opts.WriteWait))
+	})
+
+	c.mux.Lock()
+	c.session = sess.Token
+	c.ws = ws
+	c.mux.Unlock()
+	return ws, nil
+}
+
+//read connection until it fails, then reconnect - until Close
+func (c *Client) run(ws *websocket.Conn) {
+	//pushes are sent only from here, so channels are closed when nothing can send on them
+	defer close(c.lists)
+	defer close(c.events)
+	for {
+		err := c.read(ws)
+		c.disconnected(ws)
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+		utl.WARN("wsclient", "connection lost", err)
+
+		ws = nil
+		backoff := c.opts.MinBackoff
+		for ws == nil {
+			//jitter - clients of failed weblayer do not reconnect at the same moment
+			delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+			select {
+			case <-c.closed:
+				return
+			case <-time.After(delay):
+			}
+			if ws, err = c.connect(); err != nil {
+				utl.WARN("wsclient", "reconnect", err)
+			} else {
+				utl.INFO("wsclient", "reconnected", c.opts.URL)
+			}
+			select {
+			case <-c.closed:
+				//closed while dialing
+				if ws != nil {
+					c.disconnected(ws)
+				}
+				return
+			default:
+			}
+			if backoff *= 2; backoff > c.opts.MaxBackoff {
+				backoff = c.opts.MaxBackoff
+			}
+		}
+	}
+}
+
+//dispatch messages until read fails
+func (c *Client) read(ws *websocket.Conn) error {
+	for {
+		_, m, err := ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		ws.SetReadDeadline(time.Now().Add(c.opts.PongWait))
+		c.dispatch(m)
+	}
+}
+
+//reply to waiting call or push to channels
+func (c *Client) dispatch(m []byte) {
+	rp := messages.Reply{}
+	if err := json.Unmarshal(m, &rp); err != nil {
+		utl.WARN("wsclient", "invalid message", string(m))
+		return
+	}
+	if rp.RequestID != "" {
+		c.mux.Lock()
+		wait := c.pending[rp.RequestID]
+		c.mux.Unlock()
+		//buffered for one reply - duplicate is dropped
+		select {
+		case wait <- m:
+		default:
+		}
+		return
+	}
+	switch rp.Cmd {
+	case messages.SrvListAllUsers:
+		list := messages.AllUserlist{}
+		if json.Unmarshal(m, &list) == nil {
+			pushList(c.lists, list)
+		}
+	case messages.SrvAnnouncement:
+		a := messages.Announcement{}
+		if json.Unmarshal(m, &a) == nil {
+			pushEvent(c.events, a)
+		}
+	case messages.SrvPresence:
+		p := messages.Presence{}
+		if json.Unmarshal(m, &p) == nil {
+			pushEvent(c.events, p)
+		}
+	}
+}
+
+//queue list, dropping oldest when consumer is slow
+func pushList(ch chan messages.AllUserlist, list messages.AllUserlist) {
+	for {
+		select {
+		case ch <- list:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
+
+//queue event, dropping it when consumer is slow
+func pushEvent(ch chan interface{}, e interface{}) {
+	select {
+	case ch <- e:
+	default:
+		utl.WARN("wsclient", "event dropped - consumer is slow")
+	}
+}
+
+//forget connection and fail calls waiting on it
+func (c *Client) disconnected(ws *websocket.Conn) {
+	ws.Close()
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.ws == ws {
+		c.ws = nil
+	}
+	for id, wait := range c.pending {
+		close(wait)
+		delete(c.pending, id)
+	}
+}